@@ -0,0 +1,231 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"wrapter/config"
+	"wrapter/utils"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	configShowOutput   string
+	configMigratePrint bool
+)
+
+// Config command group
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect and validate the wrapter configuration",
+}
+
+// Config validate command
+var configValidateCmd = &cobra.Command{
+	Use:         "validate",
+	Short:       "Validate invoke.yaml and the other configuration layers against the schema",
+	Annotations: map[string]string{skipConfigAnnotation: ""},
+	Run: func(cmd *cobra.Command, args []string) {
+		problems, err := config.Validate(loadOptions())
+		if err != nil {
+			utils.LogErrorAndExit("Validation failed", err)
+		}
+		if len(problems) == 0 {
+			fmt.Println("Configuration is valid")
+			return
+		}
+		for _, problem := range problems {
+			fmt.Fprintln(os.Stderr, problem)
+		}
+		utils.LogErrorAndExit("Validation failed", fmt.Errorf("%d problem(s) found", len(problems)))
+	},
+}
+
+// Config show command
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print the effective merged configuration",
+	Run: func(cmd *cobra.Command, args []string) {
+		data, err := yaml.Marshal(cfg)
+		if err != nil {
+			utils.LogErrorAndExit("Failed to render config", err)
+		}
+
+		switch configShowOutput {
+		case "yaml":
+			fmt.Print(string(data))
+		case "json":
+			var generic interface{}
+			if err := yaml.Unmarshal(data, &generic); err != nil {
+				utils.LogErrorAndExit("Failed to render config", err)
+			}
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(generic); err != nil {
+				utils.LogErrorAndExit("Failed to render config", err)
+			}
+		default:
+			utils.LogErrorAndExit("Failed to render config", fmt.Errorf("unsupported output format %q, expected yaml or json", configShowOutput))
+		}
+	},
+}
+
+// Config explain command
+var configExplainCmd = &cobra.Command{
+	Use:   "explain [path]",
+	Short: "Show the environment, account, region and state a stack directory resolves to",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		path, err := os.Getwd()
+		if err != nil {
+			utils.LogErrorAndExit("Explain failed", err)
+		}
+		if len(args) == 1 {
+			if path, err = filepath.Abs(args[0]); err != nil {
+				utils.LogErrorAndExit("Explain failed", err)
+			}
+		}
+
+		// The .wrapter.yaml files between the root and the explained directory apply
+		stackCfg, err := cfg.ForDir(path)
+		if err != nil {
+			utils.LogErrorAndExit("Explain failed", err)
+		}
+		target, err := config.NewResolver(stackCfg).Resolve("", path)
+		if err != nil {
+			utils.LogErrorAndExit("Explain failed", err)
+		}
+
+		state := stackCfg.StateFor(target.Environment)
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(writer, "Environment:\t%s\t%s\n", target.Environment, layoutOrigin(stackCfg))
+		fmt.Fprintf(writer, "Account:\t%s\t%s\n", target.AccountID, stackCfg.Origin("environments."+target.Environment+".account"))
+		fmt.Fprintf(writer, "Region:\t%s\t%s\n", target.Region, stackCfg.OriginNear("default_regions."+target.AccountID))
+		fmt.Fprintf(writer, "Backend:\t%s\t%s\n", state.Type, stateOrigin(stackCfg, target.Environment, "type"))
+		fmt.Fprintf(writer, "Endpoint:\t%s\t%s\n", target.Endpoint, stateOrigin(stackCfg, target.Environment, "endpoint"))
+		fmt.Fprintf(writer, "Bucket:\t%s\t%s\n", target.Bucket, stateOrigin(stackCfg, target.Environment, "bucket"))
+		fmt.Fprintf(writer, "State key:\t%s\t%s\n", target.StateKey, stateOrigin(stackCfg, target.Environment, "key_prefix"))
+		writer.Flush()
+	},
+}
+
+// Config sources command
+var configSourcesCmd = &cobra.Command{
+	Use:   "sources",
+	Short: "Show which configuration layer set each value",
+	Run: func(cmd *cobra.Command, args []string) {
+		paths := make([]string, 0, len(cfg.Origins))
+		for path := range cfg.Origins {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, "KEY\tSOURCE")
+		for _, path := range paths {
+			fmt.Fprintf(writer, "%s\t%s\n", path, cfg.Origin(path))
+		}
+		writer.Flush()
+	},
+}
+
+// Config schema command
+var configSchemaCmd = &cobra.Command{
+	Use:         "schema",
+	Short:       "Print the JSON Schema of invoke.yaml for editor completion and validation",
+	Annotations: map[string]string{skipConfigAnnotation: ""},
+	Run: func(cmd *cobra.Command, args []string) {
+		// Outside a repository, or with a broken configuration, the schema only knows the built-in regions
+		loaded, err := config.Load(loadOptions())
+		if err != nil {
+			loaded = nil
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(config.GenerateSchema(loaded)); err != nil {
+			utils.LogErrorAndExit("Failed to render schema", err)
+		}
+	},
+}
+
+// Config migrate command
+var configMigrateCmd = &cobra.Command{
+	Use:         "migrate [file...]",
+	Short:       "Upgrade configuration files to the current format version, keeping comments and anchors",
+	Long:        "Upgrade configuration files to the current format version in place. Without arguments the configuration file and the invoke.local.yaml next to it are migrated.",
+	Annotations: map[string]string{skipConfigAnnotation: ""},
+	Run: func(cmd *cobra.Command, args []string) {
+		files := args
+		if len(files) == 0 {
+			_, file, err := config.Locate(loadOptions())
+			if err != nil {
+				utils.LogErrorAndExit("Migration failed", err)
+			}
+			files = []string{file}
+			if local := filepath.Join(filepath.Dir(file), config.LocalConfigFile); fileExists(local) {
+				files = append(files, local)
+			}
+		}
+
+		for _, file := range files {
+			data, from, err := config.MigrateFile(file)
+			if err != nil {
+				utils.LogErrorAndExit("Migration failed", err)
+			}
+			if configMigratePrint {
+				fmt.Print(string(data))
+				continue
+			}
+			if from == config.CurrentVersion {
+				fmt.Printf("%s is already at version %d\n", file, config.CurrentVersion)
+				continue
+			}
+			if err := os.WriteFile(file, data, 0644); err != nil {
+				utils.LogErrorAndExit("Migration failed", err)
+			}
+			fmt.Printf("%s migrated from version %d to %d\n", file, from, config.CurrentVersion)
+			for _, step := range config.MigrationSteps(from) {
+				fmt.Printf("  %s\n", step)
+			}
+		}
+	},
+}
+
+// fileExists reports whether a regular file exists at path
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// layoutOrigin describes where the environment of a stack comes from: its path, read through
+// the configured layout or the default one
+func layoutOrigin(stackCfg *config.Config) string {
+	if stackCfg.Layout == "" {
+		return "path, default layout " + config.DefaultLayout
+	}
+	return fmt.Sprintf("path, layout %s from %s", stackCfg.Layout, stackCfg.Origin("layout"))
+}
+
+// stateOrigin returns where a state setting of an environment was defined, "default" if nowhere
+func stateOrigin(stackCfg *config.Config, environment, key string) string {
+	for _, path := range []string{"environments." + environment + ".state." + key, "state." + key} {
+		if origin := stackCfg.Origin(path); origin != "" {
+			return origin
+		}
+	}
+	return "default"
+}
+
+func init() {
+	configShowCmd.Flags().StringVarP(&configShowOutput, "output", "o", "yaml", "Output format: yaml or json")
+	configMigrateCmd.Flags().BoolVar(&configMigratePrint, "print", false, "Print the migrated files instead of rewriting them")
+
+	configCmd.AddCommand(configValidateCmd, configShowCmd, configExplainCmd, configSourcesCmd, configSchemaCmd, configMigrateCmd)
+	rootCmd.AddCommand(configCmd)
+}
@@ -13,12 +13,14 @@ var docCmd = &cobra.Command{
 	Short: "Generate documentation",
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("Generating documentation...")
-		if err := utils.GenerateDocs(cfg); err != nil {
+		if err := utils.GenerateDocs(cmd.Context(), cfg, batchDirs(), batchOptions); err != nil {
 			utils.LogErrorAndExit("Documentation generation failed", err)
 		}
 	},
 }
 
 func init() {
+	addBatchFlags(docCmd)
+
 	rootCmd.AddCommand(docCmd)
 }
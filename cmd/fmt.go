@@ -13,12 +13,14 @@ var fmtCmd = &cobra.Command{
 	Short: "Format the Terraform code",
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("Formatting Terraform code...")
-		if err := utils.FormatCode(cfg); err != nil {
+		if err := utils.FormatCode(cmd.Context(), cfg, batchDirs(), batchOptions); err != nil {
 			utils.LogErrorAndExit("Formatting failed", err)
 		}
 	},
 }
 
 func init() {
+	addBatchFlags(fmtCmd)
+
 	rootCmd.AddCommand(fmtCmd)
 }
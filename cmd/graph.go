@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"wrapter/utils"
+
+	"github.com/spf13/cobra"
+)
+
+var graphOutput string
+
+// Graph command
+var graphCmd = &cobra.Command{
+	Use:   "graph",
+	Short: "Print the dependency graph of the stacks",
+	Long:  "Print the dependency graph of the stacks. A stack depends on the stacks whose state it reads through terraform_remote_state data sources; multi-stack init and plan run dependencies first.",
+	Run: func(cmd *cobra.Command, args []string) {
+		graph, err := utils.BuildGraph(cfg)
+		if err != nil {
+			utils.LogErrorAndExit("Building the dependency graph failed", err)
+		}
+
+		switch graphOutput {
+		case "dot":
+			fmt.Print(graph.DOT())
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(graph); err != nil {
+				utils.LogErrorAndExit("Building the dependency graph failed", err)
+			}
+		default:
+			utils.LogErrorAndExit("Building the dependency graph failed", fmt.Errorf("unsupported output format %q, expected dot or json", graphOutput))
+		}
+	},
+}
+
+func init() {
+	graphCmd.Flags().StringVarP(&graphOutput, "output", "o", "dot", "Output format: dot or json")
+
+	rootCmd.AddCommand(graphCmd)
+}
@@ -13,12 +13,13 @@ var initCmd = &cobra.Command{
 	Short: "Initialize the Terraform backend",
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("Initializing Terraform backend...")
-		if err := utils.InitializeBackend(cfg); err != nil {
+		if err := runOnStacks(cmd.Context(), utils.InitializeBackend); err != nil {
 			utils.LogErrorAndExit("Initialization failed", err)
 		}
 	},
 }
 
 func init() {
+	addChangedFlags(initCmd)
 	rootCmd.AddCommand(initCmd)
 }
@@ -13,12 +13,14 @@ var lintCmd = &cobra.Command{
 	Short: "Run the linter",
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("Running linter...")
-		if err := utils.RunLinter(cfg); err != nil {
+		if err := utils.RunLinter(cmd.Context(), cfg, batchDirs(), batchOptions); err != nil {
 			utils.LogErrorAndExit("Linter failed", err)
 		}
 	},
 }
 
 func init() {
+	addBatchFlags(lintCmd)
+
 	rootCmd.AddCommand(lintCmd)
 }
@@ -13,12 +13,14 @@ var lockCmd = &cobra.Command{
 	Short: "Set providers lock",
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("Setting providers lock...")
-		if err := utils.LockProviders(cfg); err != nil {
+		if err := utils.LockProviders(cmd.Context(), cfg, batchDirs(), batchOptions); err != nil {
 			utils.LogErrorAndExit("Locking providers failed", err)
 		}
 	},
 }
 
 func init() {
+	addBatchFlags(lockCmd)
+
 	rootCmd.AddCommand(lockCmd)
 }
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"wrapter/utils"
+
+	"github.com/spf13/cobra"
+)
+
+var lsOutput string
+
+// Ls command
+var lsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the stacks of the repository",
+	Long:  "List the stacks of the repository with their environment, account, region, team, service, module version and components. Filters accept globs and can be repeated or comma separated.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := stackFilter.Validate(); err != nil {
+			utils.LogErrorAndExit("Listing stacks failed", err)
+		}
+		inventory, err := utils.Inventory(cfg)
+		if err != nil {
+			utils.LogErrorAndExit("Listing stacks failed", err)
+		}
+		stacks := stackFilter.Filter(inventory)
+		if changed := changedStacks(); changed != nil {
+			var selected []*utils.StackInfo
+			for _, info := range stacks {
+				if changed[info.ID] {
+					selected = append(selected, info)
+				}
+			}
+			stacks = selected
+		}
+
+		switch lsOutput {
+		case "table":
+			writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(writer, "STACK\tKIND\tENV\tACCOUNT\tREGION\tTEAM\tSERVICE\tMODULE\tCOMPONENTS")
+			for _, stack := range stacks {
+				fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", stack.ID, stack.Kind, stack.Environment, stack.Account, stack.Region,
+					stack.Team, stack.Service, orDash(stack.ModuleVersion), orDash(strings.Join(stack.Components, ",")))
+			}
+			writer.Flush()
+		case "json":
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if stacks == nil {
+				stacks = []*utils.StackInfo{}
+			}
+			if err := encoder.Encode(stacks); err != nil {
+				utils.LogErrorAndExit("Listing stacks failed", err)
+			}
+		case "csv":
+			writer := csv.NewWriter(os.Stdout)
+			writer.Write([]string{"stack", "kind", "env", "account", "region", "team", "service", "module_version", "components", "dir"})
+			for _, stack := range stacks {
+				writer.Write([]string{stack.ID, stack.Kind, stack.Environment, stack.Account, stack.Region,
+					stack.Team, stack.Service, stack.ModuleVersion, strings.Join(stack.Components, ";"), stack.Dir})
+			}
+			writer.Flush()
+			if err := writer.Error(); err != nil {
+				utils.LogErrorAndExit("Listing stacks failed", err)
+			}
+		default:
+			utils.LogErrorAndExit("Listing stacks failed", fmt.Errorf("unsupported output format %q, expected table, json or csv", lsOutput))
+		}
+	},
+}
+
+// orDash returns value, or "-" when it is empty
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func init() {
+	lsCmd.Flags().StringVarP(&lsOutput, "output", "o", "table", "Output format: table, json or csv")
+	addSelectorFlags(lsCmd)
+	lsCmd.Flags().StringSliceVar(&stackFilter.ModuleVersion, "module-version", nil, "Only stacks using these common module versions")
+	lsCmd.Flags().StringSliceVar(&stackFilter.Component, "component", nil, "Only stacks enabling one of these components")
+
+	rootCmd.AddCommand(lsCmd)
+}
@@ -13,12 +13,13 @@ var planCmd = &cobra.Command{
 	Short: "Generate a Terraform plan",
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("Generating Terraform plan...")
-		if err := utils.Plan(cfg); err != nil {
+		if err := runOnStacks(cmd.Context(), utils.Plan); err != nil {
 			utils.LogErrorAndExit("Plan generation failed", err)
 		}
 	},
 }
 
 func init() {
+	addChangedFlags(planCmd)
 	rootCmd.AddCommand(planCmd)
 }
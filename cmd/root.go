@@ -1,6 +1,13 @@
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"wrapter/common"
 	"wrapter/config"
 	"wrapter/utils"
 
@@ -9,26 +16,257 @@ import (
 
 var cfg *config.Config
 
+// skipConfigAnnotation marks commands that load the configuration themselves
+const skipConfigAnnotation = "wrapter/skip-config"
+
+var (
+	// configOverrides holds the --set key.path=value flags, the highest configuration layer
+	configOverrides []string
+	// stackPatterns holds the --stack IDs and globs selecting the stacks to work on
+	stackPatterns []string
+	// stackFilter holds the selector flags of the batch commands and ls, see addSelectorFlags
+	stackFilter utils.StackFilter
+	// changedOnly and changedBase hold the --changed and --base flags, see addChangedFlags
+	changedOnly bool
+	changedBase string
+	// batchOptions holds the -j, --keep-going, --log-dir and --stack-timeout flags of the batch commands
+	batchOptions utils.BatchOptions
+	// configFile, configRoot and cliConfigFile locate the configuration, see config.LoadOptions
+	configFile    string
+	configRoot    string
+	cliConfigFile string
+	// dryRun prints the tool invocations instead of running them
+	dryRun bool
+	// timeout limits the whole command, gracePeriod how long interrupted processes get to stop
+	timeout     time.Duration
+	gracePeriod time.Duration
+	// stopTimeout releases the --timeout context once the command is done
+	stopTimeout context.CancelFunc = func() {}
+)
+
 // Root command
 var rootCmd = &cobra.Command{
 	Use:   "wrapter",
 	Short: "Wrapter - A Terraform wrapper in Go",
 	Long:  `Wrapter is a CLI tool to manage Terraform codes for the Microservices requirements.`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		utils.DryRun = dryRun
+		if dryRun {
+			utils.CommandRunner = &utils.RecordingRunner{Print: true}
+		} else {
+			utils.CommandRunner = &utils.ExecRunner{GracePeriod: gracePeriod}
+		}
+		if timeout > 0 {
+			var ctx context.Context
+			ctx, stopTimeout = context.WithTimeoutCause(cmd.Context(), timeout, fmt.Errorf("command timed out after %s", timeout))
+			cmd.SetContext(ctx)
+		}
+		if _, skip := cmd.Annotations[skipConfigAnnotation]; !skip {
+			initConfig()
+		}
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
+// SIGINT and SIGTERM cancel the context of the command: no new stack is started and the
+// running tofu processes are interrupted, then killed after the grace period.
 func Execute() error {
-	return rootCmd.Execute()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		for sig := range signals {
+			fmt.Fprintf(os.Stderr, "\nReceived %s, stopping: running commands are interrupted and killed if they don't exit within %s\n", sig, gracePeriod)
+			cancel(fmt.Errorf("interrupted by %s", sig))
+		}
+	}()
+
+	defer func() { stopTimeout() }()
+	return rootCmd.ExecuteContext(ctx)
 }
 
 func init() {
-	cobra.OnInitialize(initConfig)
+	rootCmd.Version = common.Version
+	rootCmd.PersistentFlags().StringArrayVar(&configOverrides, "set", nil, "Override a configuration value as key.path=value (can be repeated)")
+	rootCmd.PersistentFlags().StringArrayVar(&stackPatterns, "stack", nil, "Stack ID or glob to work on instead of the current directory, e.g. prod/us-east-1/payments/ledger or '*/*/payments/*' (can be repeated)")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "Configuration file to use instead of discovering invoke.yaml (env "+config.EnvConfigFile+")")
+	rootCmd.PersistentFlags().StringVar(&configRoot, "root", "", "Repository root the stack paths are relative to (env "+config.EnvRoot+")")
+	rootCmd.PersistentFlags().DurationVar(&timeout, "timeout", 0, "Time limit of the whole command, e.g. 30m (none by default)")
+	rootCmd.PersistentFlags().DurationVar(&batchOptions.StackTimeout, "stack-timeout", 0, "Time limit of each stack, e.g. 10m (none by default)")
+	rootCmd.PersistentFlags().DurationVar(&gracePeriod, "grace-period", utils.DefaultGracePeriod, "Time interrupted tofu processes get to release their locks before they are killed")
+	rootCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "Print the commands that would run, secrets masked, without running them")
+	rootCmd.PersistentFlags().StringVar(&cliConfigFile, "cli-config", "", "OpenTofu CLI configuration file, terraform.tfrc in the root by default (env "+config.EnvCLIConfigFile+")")
+}
+
+// loadOptions returns the configuration load options built from the global flags
+func loadOptions() config.LoadOptions {
+	return config.LoadOptions{
+		Filename:      "invoke.yaml",
+		ConfigFile:    configFile,
+		Root:          configRoot,
+		CLIConfigFile: cliConfigFile,
+		Overrides:     configOverrides,
+	}
 }
 
 func initConfig() {
 	var err error
-	cfg, err = config.LoadConfig("invoke.yaml")
+	cfg, err = config.Load(loadOptions())
 	if err != nil {
 		utils.LogErrorAndExit("Failed to load config", err)
 	}
 }
+
+// selectedStacks returns the stacks selected with --stack, nil when the flag isn't used
+func selectedStacks() []*config.Stack {
+	if len(stackPatterns) == 0 {
+		return nil
+	}
+	stacks, err := config.NewResolver(cfg).SelectStacks(stackPatterns)
+	if err != nil {
+		utils.LogErrorAndExit("Failed to select stacks", err)
+	}
+	return stacks
+}
+
+// changedStacks returns the IDs of the stacks changed since --base, nil when --changed isn't used
+func changedStacks() map[string]bool {
+	if !changedOnly {
+		return nil
+	}
+	changed, err := utils.ChangedStacks(cfg, changedBase)
+	if err != nil {
+		utils.LogErrorAndExit("Failed to find the changed stacks", err)
+	}
+	return changed
+}
+
+// runOnStacks runs fn in every stack selected with --stack and --changed in dependency order,
+// or in the current directory, with the configuration applying to that directory
+func runOnStacks(ctx context.Context, fn func(ctx context.Context, stackCfg *config.Config, dir string) error) error {
+	stacks := selectedStacks()
+	if changed := changedStacks(); changed != nil {
+		if stacks == nil {
+			all, err := config.NewResolver(cfg).FindStacks()
+			if err != nil {
+				return err
+			}
+			stacks = all
+		}
+		var selected []*config.Stack
+		for _, stack := range stacks {
+			if changed[stack.ID] {
+				selected = append(selected, stack)
+			}
+		}
+		if len(selected) == 0 {
+			fmt.Printf("No stack changed since %s\n", changedBase)
+			return nil
+		}
+		stacks = selected
+	}
+	if stacks == nil {
+		dir, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		return fn(ctx, cfg, dir)
+	}
+
+	return utils.RunInOrder(ctx, cfg, stacks, batchOptions.StackTimeout, func(ctx context.Context, stack *config.Stack) error {
+		stackCfg, err := cfg.ForDir(stack.Dir)
+		if err != nil {
+			return err
+		}
+		return fn(ctx, stackCfg, stack.Dir)
+	})
+}
+
+// addSelectorFlags adds the flags selecting stacks by their inventory attributes to a command
+func addSelectorFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVar(&stackFilter.Environment, "env", nil, "Only stacks of these environments")
+	cmd.Flags().StringSliceVar(&stackFilter.Account, "account", nil, "Only stacks of these accounts")
+	cmd.Flags().StringSliceVar(&stackFilter.Region, "region", nil, "Only stacks in these regions")
+	cmd.Flags().StringSliceVar(&stackFilter.Team, "team", nil, "Only stacks of these teams")
+	cmd.Flags().StringSliceVar(&stackFilter.Service, "service", nil, "Only stacks of these services")
+	cmd.Flags().StringSliceVar(&stackFilter.Kind, "kind", nil, "Only stacks of this kind: common or custom")
+	addChangedFlags(cmd)
+}
+
+// addChangedFlags adds the flags selecting the stacks changed in git to a command
+func addChangedFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&changedOnly, "changed", false, "Only stacks whose files, local modules or configuration changed since --base, uncommitted changes included")
+	cmd.Flags().StringVar(&changedBase, "base", utils.DefaultBase, "Git revision --changed compares with, through its merge base with HEAD")
+}
+
+// addBatchFlags adds the selector, parallelism, error handling and log flags to a batch command
+func addBatchFlags(cmd *cobra.Command) {
+	addSelectorFlags(cmd)
+	cmd.Flags().IntVarP(&batchOptions.Parallelism, "parallelism", "j", 1, "Number of stacks processed at once")
+	cmd.Flags().BoolVar(&batchOptions.KeepGoing, "keep-going", false, "Process every stack even after a failure and report the results at the end")
+	cmd.Flags().StringVar(&batchOptions.LogDir, "log-dir", "", "Directory of the per stack log files, "+utils.DefaultLogDir+" in the repository root by default")
+}
+
+// batchDirs returns the directories batch commands work on: the stacks selected with --stack,
+// --changed and the selector flags, or every stack directory below the current one
+func batchDirs() []string {
+	selected := selectedStacks()
+	if selected == nil && stackFilter.Empty() && !changedOnly {
+		dirs, err := utils.ListDirs(cfg)
+		if err != nil {
+			utils.LogErrorAndExit("Failed to list directories", err)
+		}
+		return dirs
+	}
+
+	stacks, err := filteredStacks(selected)
+	if err != nil {
+		utils.LogErrorAndExit("Failed to select stacks", err)
+	}
+	if len(stacks) == 0 {
+		fmt.Printf("No stack changed since %s\n", changedBase)
+	}
+	dirs := make([]string, 0, len(stacks))
+	for _, stack := range stacks {
+		dirs = append(dirs, stack.Dir)
+	}
+	return dirs
+}
+
+// filteredStacks returns the stacks of the inventory matching the selector flags, restricted
+// to the stacks selected with --stack and --changed when they are used. Nothing having changed
+// isn't an error.
+func filteredStacks(selected []*config.Stack) ([]*utils.StackInfo, error) {
+	if err := stackFilter.Validate(); err != nil {
+		return nil, err
+	}
+	inventory, err := utils.Inventory(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := changedStacks()
+	var stacks []*utils.StackInfo
+	for _, info := range stackFilter.Filter(inventory) {
+		if (selected == nil || containsStack(selected, info.ID)) && (changed == nil || changed[info.ID]) {
+			stacks = append(stacks, info)
+		}
+	}
+	if len(stacks) == 0 && changed == nil {
+		return nil, fmt.Errorf("no stack matches the selection")
+	}
+	return stacks, nil
+}
+
+// containsStack reports whether a stack with the given ID is in the list
+func containsStack(stacks []*config.Stack, id string) bool {
+	for _, stack := range stacks {
+		if stack.ID == id {
+			return true
+		}
+	}
+	return false
+}
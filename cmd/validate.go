@@ -13,12 +13,14 @@ var validateCmd = &cobra.Command{
 	Short: "Validate the Terraform configuration",
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("Validating Terraform configuration...")
-		if err := utils.ValidateConfiguration(cfg); err != nil {
+		if err := utils.ValidateConfiguration(cmd.Context(), cfg, batchDirs(), batchOptions); err != nil {
 			utils.LogErrorAndExit("Validation failed", err)
 		}
 	},
 }
 
 func init() {
+	addBatchFlags(validateCmd)
+
 	rootCmd.AddCommand(validateCmd)
 }
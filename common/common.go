@@ -1,6 +1,7 @@
 package common
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 )
@@ -12,7 +13,12 @@ func FindGitRoot() (string, error) {
 	if err != nil {
 		return "", err
 	}
+	return FindGitRootFrom(dir)
+}
 
+// FindGitRootFrom finds the root directory of the Git repository containing dir
+func FindGitRootFrom(dir string) (string, error) {
+	start := dir
 	for {
 		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
 			return dir, nil
@@ -20,8 +26,11 @@ func FindGitRoot() (string, error) {
 
 		parent := filepath.Dir(dir)
 		if parent == dir {
-			return "", err
+			return "", fmt.Errorf("no .git found in %s or any of its parent directories", start)
 		}
 		dir = parent
 	}
 }
+
+// Version of the wrapter binary, set at build time with -ldflags "-X wrapter/common.Version=1.2.3"
+var Version = "dev"
@@ -0,0 +1,379 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Backend types supported in state.type
+const (
+	BackendMinio = "minio" // S3 backend against a MinIO (or other S3-compatible) endpoint, the default
+	BackendS3    = "s3"    // Native AWS S3, credentials come from the AWS SDK chain or a profile option
+	BackendHTTP  = "http"  // HTTP backend of a state service, the endpoint is the base address
+	BackendLocal = "local" // Local state files, the endpoint is the base directory
+)
+
+// Backend knows how a state backend type is configured: the settings passed to tofu init
+// and the HCL blocks written into generated stacks
+type Backend interface {
+	// Type returns the OpenTofu backend type name
+	Type() string
+	// InitConfig returns the non-secret key=value settings passed to tofu init as -backend-config
+	InitConfig(target *Target) []string
+	// CredentialConfig returns the secret settings tofu init needs for the given credentials, if any
+	CredentialConfig(creds *Credentials) map[string]string
+	// BackendBlock returns the backend block written inside the terraform block of provider.tf
+	BackendBlock() string
+	// RemoteStateBlock returns a terraform_remote_state data source reading the target's state,
+	// written to the stack directory dir
+	RemoteStateBlock(name string, target *Target, dir string) string
+	// RemoteStateVariables returns the declarations of the input variables RemoteStateBlock
+	// reads, empty when it reads none
+	RemoteStateVariables(target *Target) string
+	// RemoteStateEnv returns the environment entries giving RemoteStateBlock the credentials of
+	// the backend: TF_VAR_<name>=value for its variables, or the variables the backend's SDK reads
+	RemoteStateEnv(creds *Credentials) []string
+}
+
+// NewBackend returns the backend implementation of the given type. Relative local state
+// directories are resolved against root.
+func NewBackend(backendType, root string) (Backend, error) {
+	switch backendType {
+	case "", BackendMinio:
+		return minioBackend{}, nil
+	case BackendS3:
+		return s3Backend{}, nil
+	case BackendHTTP:
+		return httpBackend{}, nil
+	case BackendLocal:
+		return localBackend{root: root}, nil
+	default:
+		return nil, fmt.Errorf("unsupported state backend type %q; expected one of: %s, %s, %s, %s", backendType, BackendMinio, BackendS3, BackendHTTP, BackendLocal)
+	}
+}
+
+// BackendConfig returns the non-secret backend settings of the target as key=value pairs for -backend-config
+func (t *Target) BackendConfig() []string {
+	return t.Backend.InitConfig(t)
+}
+
+// minioBackend stores state with the s3 backend on a MinIO endpoint using MINIO_* credentials
+type minioBackend struct{}
+
+func (minioBackend) Type() string { return "s3" }
+
+func (minioBackend) InitConfig(target *Target) []string {
+	settings := []string{
+		"endpoint=" + target.Endpoint,
+		"bucket=" + target.Bucket,
+		"region=" + target.Region,
+	}
+	if target.StateKey != "" {
+		settings = append(settings, "key="+target.StateKey)
+	}
+	return append(settings, optionSettings(target)...)
+}
+
+func (minioBackend) CredentialConfig(creds *Credentials) map[string]string {
+	return awsCredentialConfig(creds)
+}
+
+func (minioBackend) BackendBlock() string {
+	return `  backend "s3" {
+    skip_credentials_validation = true
+    skip_metadata_api_check     = true
+  }
+`
+}
+
+// Input variables the minio remote state block reads the backend credentials from, set by
+// RemoteStateEnv whatever the credentials source
+const (
+	minioAccessKeyVariable    = "MINIO_ACCESS_KEY"
+	minioSecretKeyVariable    = "MINIO_SECRET_KEY"
+	minioSessionTokenVariable = "MINIO_SESSION_TOKEN"
+)
+
+func (minioBackend) RemoteStateBlock(name string, target *Target, _ string) string {
+	attributes := [][2]string{
+		{"endpoint", quote(target.Endpoint)},
+		{"bucket", quote(target.Bucket)},
+		{"key", quote(target.StateKey)},
+		{"region", quote(target.Region)},
+	}
+	attributes = append(attributes, minioRemoteStateCredentials(target)...)
+	return remoteStateBlock(name, "s3", append(attributes,
+		[2]string{"skip_credentials_validation", "true"},
+		[2]string{"skip_metadata_api_check", "true"},
+		[2]string{"skip_requesting_account_id", "true"},
+	), target)
+}
+
+func (minioBackend) RemoteStateVariables(target *Target) string {
+	if target.Credentials.Source == CredentialsProfile {
+		return ""
+	}
+	return fmt.Sprintf(`variable %q {
+  type      = string
+  sensitive = true
+}
+
+variable %q {
+  type      = string
+  sensitive = true
+}
+
+variable %q {
+  type      = string
+  default   = null
+  sensitive = true
+}
+`, minioAccessKeyVariable, minioSecretKeyVariable, minioSessionTokenVariable)
+}
+
+func (minioBackend) RemoteStateEnv(creds *Credentials) []string {
+	return environmentEntries("TF_VAR_", [][2]string{
+		{minioAccessKeyVariable, creds.AccessKey},
+		{minioSecretKeyVariable, creds.SecretKey},
+		{minioSessionTokenVariable, creds.SessionToken},
+	})
+}
+
+// minioRemoteStateCredentials returns the credential attributes of the minio remote state
+// block: the profile of the profile source, otherwise the variables set by RemoteStateEnv
+func minioRemoteStateCredentials(target *Target) [][2]string {
+	if target.Credentials.Source == CredentialsProfile {
+		return [][2]string{{"profile", quote(target.Credentials.Profile)}}
+	}
+	return [][2]string{
+		{"access_key", "var." + minioAccessKeyVariable},
+		{"secret_key", "var." + minioSecretKeyVariable},
+		{"token", "var." + minioSessionTokenVariable},
+	}
+}
+
+// s3Backend stores state in native AWS S3; credentials come from the environment or a profile option
+type s3Backend struct{}
+
+func (s3Backend) Type() string { return "s3" }
+
+func (s3Backend) InitConfig(target *Target) []string {
+	settings := []string{
+		"bucket=" + target.Bucket,
+		"region=" + target.Region,
+	}
+	if target.StateKey != "" {
+		settings = append(settings, "key="+target.StateKey)
+	}
+	return append(settings, optionSettings(target)...)
+}
+
+func (s3Backend) CredentialConfig(creds *Credentials) map[string]string {
+	return awsCredentialConfig(creds)
+}
+
+func (s3Backend) BackendBlock() string {
+	return `  backend "s3" {}
+`
+}
+
+func (s3Backend) RemoteStateBlock(name string, target *Target, _ string) string {
+	attributes := [][2]string{
+		{"bucket", quote(target.Bucket)},
+		{"key", quote(target.StateKey)},
+		{"region", quote(target.Region)},
+	}
+	// Other sources reach the remote state through the AWS SDK chain, see RemoteStateEnv
+	if target.Credentials.Source == CredentialsProfile {
+		attributes = append(attributes, [2]string{"profile", quote(target.Credentials.Profile)})
+	}
+	return remoteStateBlock(name, "s3", attributes, target)
+}
+
+func (s3Backend) RemoteStateVariables(*Target) string { return "" }
+
+// RemoteStateEnv exports the credentials as the AWS SDK variables, which the AWS provider of the
+// stack reads as well
+func (s3Backend) RemoteStateEnv(creds *Credentials) []string {
+	return environmentEntries("", [][2]string{
+		{"AWS_ACCESS_KEY_ID", creds.AccessKey},
+		{"AWS_SECRET_ACCESS_KEY", creds.SecretKey},
+		{"AWS_SESSION_TOKEN", creds.SessionToken},
+	})
+}
+
+// httpBackend stores state in a state service addressed by <endpoint>/<state key>.
+// The access and secret keys are used as the basic auth username and password.
+type httpBackend struct{}
+
+func (httpBackend) Type() string { return "http" }
+
+func (httpBackend) InitConfig(target *Target) []string {
+	var settings []string
+	if target.StateKey != "" {
+		address := httpAddress(target)
+		settings = append(settings,
+			"address="+address,
+			"lock_address="+address,
+			"unlock_address="+address,
+		)
+	}
+	return append(settings, optionSettings(target)...)
+}
+
+func (httpBackend) CredentialConfig(creds *Credentials) map[string]string {
+	settings := map[string]string{}
+	if creds.AccessKey != "" || creds.SecretKey != "" {
+		settings["username"] = creds.AccessKey
+		settings["password"] = creds.SecretKey
+	}
+	return settings
+}
+
+func (httpBackend) BackendBlock() string {
+	return `  backend "http" {}
+`
+}
+
+// Input variables the http remote state block reads the basic auth credentials from, set by
+// RemoteStateEnv; without credentials they are null and no authentication is sent
+const (
+	httpUsernameVariable = "HTTP_STATE_USERNAME"
+	httpPasswordVariable = "HTTP_STATE_PASSWORD"
+)
+
+func (httpBackend) RemoteStateBlock(name string, target *Target, _ string) string {
+	return remoteStateBlock(name, "http", [][2]string{
+		{"address", quote(httpAddress(target))},
+		{"username", "var." + httpUsernameVariable},
+		{"password", "var." + httpPasswordVariable},
+	}, target)
+}
+
+func (httpBackend) RemoteStateVariables(*Target) string {
+	return fmt.Sprintf(`variable %q {
+  type      = string
+  default   = null
+  sensitive = true
+}
+
+variable %q {
+  type      = string
+  default   = null
+  sensitive = true
+}
+`, httpUsernameVariable, httpPasswordVariable)
+}
+
+func (httpBackend) RemoteStateEnv(creds *Credentials) []string {
+	return environmentEntries("TF_VAR_", [][2]string{
+		{httpUsernameVariable, creds.AccessKey},
+		{httpPasswordVariable, creds.SecretKey},
+	})
+}
+
+// httpAddress returns the state address of the target on the state service
+func httpAddress(target *Target) string {
+	return strings.TrimSuffix(target.Endpoint, "/") + "/" + filepath.ToSlash(target.StateKey)
+}
+
+// localBackend keeps state files under a base directory, mirroring the state keys
+type localBackend struct {
+	root string
+}
+
+func (localBackend) Type() string { return "local" }
+
+func (b localBackend) InitConfig(target *Target) []string {
+	var settings []string
+	if target.StateKey != "" {
+		settings = append(settings, "path="+b.path(target))
+	}
+	return append(settings, optionSettings(target)...)
+}
+
+func (localBackend) CredentialConfig(*Credentials) map[string]string { return nil }
+
+func (localBackend) BackendBlock() string {
+	return `  backend "local" {}
+`
+}
+
+// RemoteStateBlock refers to a state under a relative base directory relative to dir, so that
+// the committed code doesn't depend on where the repository is cloned
+func (b localBackend) RemoteStateBlock(name string, target *Target, dir string) string {
+	path := b.path(target)
+	if !filepath.IsAbs(target.Endpoint) {
+		if relPath, err := filepath.Rel(dir, path); err == nil {
+			path = filepath.ToSlash(relPath)
+		}
+	}
+	return remoteStateBlock(name, "local", [][2]string{
+		{"path", quote(path)},
+	}, target)
+}
+
+func (localBackend) RemoteStateVariables(*Target) string { return "" }
+
+func (localBackend) RemoteStateEnv(*Credentials) []string { return nil }
+
+// path returns the state file of the target; the endpoint is the base directory, relative to the root
+func (b localBackend) path(target *Target) string {
+	base := target.Endpoint
+	if !filepath.IsAbs(base) {
+		base = filepath.Join(b.root, base)
+	}
+	return filepath.Join(base, target.StateKey)
+}
+
+// environmentEntries returns prefix+name=value environment entries for the variables with a value
+func environmentEntries(prefix string, variables [][2]string) []string {
+	var env []string
+	for _, variable := range variables {
+		if variable[1] != "" {
+			env = append(env, prefix+variable[0]+"="+variable[1])
+		}
+	}
+	return env
+}
+
+// optionSettings returns the additional backend settings of the target as sorted key=value pairs
+func optionSettings(target *Target) []string {
+	var settings []string
+	for _, key := range target.OptionKeys() {
+		settings = append(settings, key+"="+target.Options[key])
+	}
+	return settings
+}
+
+// remoteStateBlock renders a terraform_remote_state data source with the given attributes
+// followed by the additional backend settings of the target
+func remoteStateBlock(name, backendType string, attributes [][2]string, target *Target) string {
+	for _, key := range target.OptionKeys() {
+		attributes = append(attributes, [2]string{key, quote(target.Options[key])})
+	}
+
+	// Align the equals signs the way tofu fmt does
+	width := 0
+	for _, attribute := range attributes {
+		if len(attribute[0]) > width {
+			width = len(attribute[0])
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("data \"terraform_remote_state\" %q {\n", name))
+	sb.WriteString(fmt.Sprintf("  backend = %q\n", backendType))
+	sb.WriteString("  config = {\n")
+	for _, attribute := range attributes {
+		sb.WriteString(fmt.Sprintf("    %-*s = %s\n", width, attribute[0], attribute[1]))
+	}
+	sb.WriteString("  }\n}")
+	return sb.String()
+}
+
+// quote renders a string as an HCL string literal
+func quote(value string) string {
+	return fmt.Sprintf("%q", value)
+}
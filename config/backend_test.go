@@ -0,0 +1,140 @@
+package config
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var (
+	variableReferencePattern   = regexp.MustCompile(`\bvar\.(\w+)`)
+	variableDeclarationPattern = regexp.MustCompile(`variable\s+"(\w+)"`)
+)
+
+// matches returns the sorted distinct first groups of the pattern in text
+func matches(pattern *regexp.Regexp, text string) []string {
+	seen := map[string]bool{}
+	for _, match := range pattern.FindAllStringSubmatch(text, -1) {
+		seen[match[1]] = true
+	}
+	names := []string{}
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRemoteStateVariables(t *testing.T) {
+	for _, backendType := range []string{BackendMinio, BackendS3, BackendHTTP, BackendLocal} {
+		for _, source := range []string{CredentialsEnv, CredentialsFile, CredentialsProfile, CredentialsProcess} {
+			checkRemoteStateVariables(t, backendType, source)
+		}
+	}
+}
+
+// checkRemoteStateVariables checks that the remote state block of a backend only reads declared
+// variables, and that the variables RemoteStateEnv sets are declared
+func checkRemoteStateVariables(t *testing.T, backendType, source string) {
+	t.Helper()
+	backend, err := NewBackend(backendType, "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &Target{
+		Endpoint: "http://minio:9000",
+		Bucket:   "company-tfstates",
+		Region:   "us-east-1",
+		StateKey: "company/111111111111/prod/us-east-1/pay/ledger/service.tfstate",
+		Backend:  backend,
+	}
+	target.Credentials.Source = source
+	target.Credentials.Profile = "ci"
+
+	referenced := matches(variableReferencePattern, backend.RemoteStateBlock("wrapter", target, "/repo/stack"))
+	declared := matches(variableDeclarationPattern, backend.RemoteStateVariables(target))
+	if strings.Join(referenced, ",") != strings.Join(declared, ",") {
+		t.Errorf("%s/%s: the remote state block reads %v but %v are declared", backendType, source, referenced, declared)
+	}
+
+	creds := &Credentials{AccessKey: "access", SecretKey: "secret", SessionToken: "token"}
+	for _, entry := range backend.RemoteStateEnv(creds) {
+		name, isVariable := strings.CutPrefix(entry, "TF_VAR_")
+		name, _, _ = strings.Cut(name, "=")
+		if isVariable && source != CredentialsProfile && !contains(declared, name) {
+			t.Errorf("%s/%s: RemoteStateEnv sets %s, which isn't declared", backendType, source, name)
+		}
+	}
+}
+
+func TestRemoteStateEnv(t *testing.T) {
+	full := &Credentials{AccessKey: "access", SecretKey: "secret", SessionToken: "token"}
+	keys := &Credentials{AccessKey: "access", SecretKey: "secret"}
+	for _, test := range []struct {
+		backendType string
+		creds       *Credentials
+		want        []string
+	}{
+		{BackendMinio, full, []string{"TF_VAR_MINIO_ACCESS_KEY=access", "TF_VAR_MINIO_SECRET_KEY=secret", "TF_VAR_MINIO_SESSION_TOKEN=token"}},
+		{BackendMinio, keys, []string{"TF_VAR_MINIO_ACCESS_KEY=access", "TF_VAR_MINIO_SECRET_KEY=secret"}},
+		{BackendS3, full, []string{"AWS_ACCESS_KEY_ID=access", "AWS_SECRET_ACCESS_KEY=secret", "AWS_SESSION_TOKEN=token"}},
+		{BackendS3, keys, []string{"AWS_ACCESS_KEY_ID=access", "AWS_SECRET_ACCESS_KEY=secret"}},
+		{BackendS3, &Credentials{}, nil},
+		{BackendHTTP, full, []string{"TF_VAR_HTTP_STATE_USERNAME=access", "TF_VAR_HTTP_STATE_PASSWORD=secret"}},
+		{BackendHTTP, &Credentials{}, nil},
+		{BackendLocal, full, nil},
+	} {
+		backend, err := NewBackend(test.backendType, "/repo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env := backend.RemoteStateEnv(test.creds); !reflect.DeepEqual(env, test.want) {
+			t.Errorf("%s with %+v: RemoteStateEnv() = %v, want %v", test.backendType, *test.creds, env, test.want)
+		}
+	}
+}
+
+func TestHTTPRemoteStateBlockAuthenticates(t *testing.T) {
+	backend, err := NewBackend(BackendHTTP, "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &Target{Endpoint: "https://state.example.com/", StateKey: "company/prod/pay/ledger/service.tfstate", Backend: backend}
+	block := backend.RemoteStateBlock("wrapter", target, "/repo/stack")
+	for _, line := range []string{
+		`address  = "https://state.example.com/company/prod/pay/ledger/service.tfstate"`,
+		"username = var.HTTP_STATE_USERNAME",
+		"password = var.HTTP_STATE_PASSWORD",
+	} {
+		if !strings.Contains(block, line) {
+			t.Errorf("the remote state block lacks %q:\n%s", line, block)
+		}
+	}
+}
+
+func TestLocalStatePaths(t *testing.T) {
+	backend, err := NewBackend(BackendLocal, "/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "company/111111111111/prod/us-east-1/pay/ledger/service.tfstate"
+	dir := "/repo/111111111111/prod/us-east-1/pay/ledger-custom"
+	for _, test := range []struct {
+		endpoint   string
+		blockPath  string
+		initConfig string
+	}{
+		{"states", "../../../../../states/" + key, "path=/repo/states/" + key},
+		{"/var/lib/states", "/var/lib/states/" + key, "path=/var/lib/states/" + key},
+	} {
+		target := &Target{Endpoint: test.endpoint, StateKey: key, Backend: backend}
+		if block := backend.RemoteStateBlock("wrapter", target, dir); !strings.Contains(block, `path = "`+test.blockPath+`"`) {
+			t.Errorf("%s: the remote state block doesn't read %s:\n%s", test.endpoint, test.blockPath, block)
+		}
+		if settings := backend.InitConfig(target); !contains(settings, test.initConfig) {
+			t.Errorf("%s: init settings %v, want %s", test.endpoint, settings, test.initConfig)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Files returns the configuration files the values were read from, relative to the root
+func (c *Config) Files() []string {
+	seen := map[string]bool{}
+	for _, origin := range c.Origins {
+		if strings.HasPrefix(origin, "env ") || strings.HasPrefix(origin, "--set ") {
+			continue
+		}
+		if i := strings.LastIndex(origin, ":"); i > 0 {
+			seen[origin[:i]] = true
+		}
+	}
+	return sortedKeys(seen)
+}
+
+// LocalFile returns the path of the local configuration file, next to the repository one
+func (c *Config) LocalFile() string {
+	return filepath.Join(filepath.Dir(c.opts.ConfigFile), LocalConfigFile)
+}
+
+// IncludePatterns returns the include patterns of a configuration file's content, relative
+// patterns resolved against dir, the directory of the file
+func IncludePatterns(data []byte, dir string) ([]string, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	if len(document.Content) == 0 {
+		return nil, nil
+	}
+	include := lookupKey(document.Content[0], "include")
+	if include == nil {
+		return nil, nil
+	}
+	if include = resolveAlias(include); include.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("include must be a list of files or globs")
+	}
+
+	var patterns []string
+	for _, item := range include.Content {
+		if item = resolveAlias(item); item.Kind != yaml.ScalarNode || item.Value == "" {
+			return nil, fmt.Errorf("include must be a list of files or globs")
+		}
+		pattern := item.Value
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// ChangedKeys compares two versions of a configuration file and returns the sorted key paths
+// of the values that differ, e.g. environments.prod.account. Both versions are migrated to the
+// current format first, so that a format upgrade alone changes nothing. Empty content stands
+// for a missing file.
+func ChangedKeys(before, after []byte) ([]string, error) {
+	beforeValues, err := flattenDocument(before)
+	if err != nil {
+		return nil, fmt.Errorf("previous version: %w", err)
+	}
+	afterValues, err := flattenDocument(after)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for path, value := range afterValues {
+		if previous, exists := beforeValues[path]; !exists || !reflect.DeepEqual(previous, value) {
+			changed = append(changed, path)
+		}
+	}
+	for path := range beforeValues {
+		if _, exists := afterValues[path]; !exists {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// flattenDocument parses a configuration file into its leaf values keyed by dotted path. The
+// version and include keys describe the file rather than the configuration and are left out.
+func flattenDocument(data []byte) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	if len(document.Content) == 0 {
+		return values, nil
+	}
+	if _, err := Migrate(&document); err != nil {
+		return nil, err
+	}
+	root := document.Content[0]
+	deleteKey(root, "version")
+	deleteKey(root, "include")
+
+	// Decoding resolves aliases and merge keys
+	var decoded interface{}
+	if err := root.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	flattenValue(decoded, "", values)
+	return values, nil
+}
+
+// flattenValue records the leaf values below a decoded YAML value. Mappings with keys that
+// aren't all strings, such as unquoted account IDs, decode with interface{} keys. Empty
+// mappings configure nothing, like missing ones, and are left out.
+func flattenValue(value interface{}, path string, values map[string]interface{}) {
+	switch mapping := value.(type) {
+	case map[string]interface{}:
+		for key, child := range mapping {
+			flattenValue(child, joinPath(path, key), values)
+		}
+	case map[interface{}]interface{}:
+		for key, child := range mapping {
+			flattenValue(child, joinPath(path, fmt.Sprint(key)), values)
+		}
+	default:
+		values[path] = value
+	}
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestChangedKeys(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		before string
+		after  string
+		want   []string
+	}{
+		{
+			name:   "unchanged",
+			before: "tofu:\n  project: company\n",
+			after:  "# a comment\ntofu:\n  project: company\n",
+			want:   nil,
+		},
+		{
+			name:   "value",
+			before: "environments:\n  prod:\n    account: \"111111111111\"\n  dev:\n    account: \"222222222222\"\n",
+			after:  "environments:\n  prod:\n    account: \"333333333333\"\n  dev:\n    account: \"222222222222\"\n",
+			want:   []string{"environments.prod.account"},
+		},
+		{
+			name:   "added and removed",
+			before: "state:\n  bucket: old\n",
+			after:  "state:\n  endpoint: http://minio:9000\n",
+			want:   []string{"state.bucket", "state.endpoint"},
+		},
+		{
+			name:   "new file",
+			before: "",
+			after:  "tofu:\n  project: company\n  version: 1.8\n",
+			want:   []string{"tofu.project", "tofu.version"},
+		},
+		{
+			name:   "deleted file",
+			before: "environments:\n  prod:\n    account: \"111111111111\"\n",
+			after:  "",
+			want:   []string{"environments.prod.account"},
+		},
+		{
+			name:   "list",
+			before: "default_regions:\n  111111111111:\n    regions: [us-east-1]\n",
+			after:  "default_regions:\n  111111111111:\n    regions: [us-east-1, us-west-2]\n",
+			want:   []string{"default_regions.111111111111.regions"},
+		},
+		{
+			name:   "anchor",
+			before: "environments:\n  dev: &dev\n    account: \"111111111111\"\n  stable: *dev\n",
+			after:  "environments:\n  dev:\n    account: \"111111111111\"\n  stable:\n    account: \"111111111111\"\n",
+			want:   nil,
+		},
+		{
+			name:   "version and include",
+			before: "version: 2\ntofu:\n  project: company\n",
+			after:  "include: [envs/*.yaml]\ntofu:\n  project: company\n",
+			want:   nil,
+		},
+		{
+			name:   "format upgrade",
+			before: "environments:\n  endpoint: http://minio:9000\n",
+			after:  "version: 2\nstate:\n  endpoint: http://minio:9000\n",
+			want:   nil,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			keys, err := ChangedKeys([]byte(test.before), []byte(test.after))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(keys, test.want) {
+				t.Errorf("ChangedKeys() = %v, want %v", keys, test.want)
+			}
+		})
+	}
+}
+
+func TestChangedKeysInvalid(t *testing.T) {
+	if _, err := ChangedKeys([]byte("tofu: [\n"), []byte("tofu: {}\n")); err == nil {
+		t.Error("ChangedKeys accepted an invalid previous version")
+	}
+}
+
+func TestIncludePatterns(t *testing.T) {
+	patterns, err := IncludePatterns([]byte("include:\n  - envs/*.yaml\n  - /etc/wrapter.yaml\n"), "/repo/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/repo/config/envs/*.yaml", "/etc/wrapter.yaml"}; !reflect.DeepEqual(patterns, want) {
+		t.Errorf("IncludePatterns() = %v, want %v", patterns, want)
+	}
+
+	if _, err := IncludePatterns([]byte("include: envs/*.yaml\n"), "/repo"); err == nil {
+		t.Error("IncludePatterns accepted an include that isn't a list")
+	}
+}
+
+func TestFilesAndLocalFile(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "invoke.yaml"), "include: [envs/*.yaml]\ntofu:\n  project: company\n")
+	writeFile(t, filepath.Join(root, "envs", "prod.yaml"), "environments:\n  prod:\n    account: \"111111111111\"\n")
+	if err := os.WriteFile(filepath.Join(root, LocalConfigFile), []byte("state:\n  bucket: mine\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(LoadOptions{Root: root, Dir: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"envs/prod.yaml", "invoke.local.yaml", "invoke.yaml"}; !reflect.DeepEqual(cfg.Files(), want) {
+		t.Errorf("Files() = %v, want %v", cfg.Files(), want)
+	}
+	if want := filepath.Join(root, LocalConfigFile); cfg.LocalFile() != want {
+		t.Errorf("LocalFile() = %s, want %s", cfg.LocalFile(), want)
+	}
+}
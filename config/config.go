@@ -1,79 +1,304 @@
 package config
 
 import (
-	"gopkg.in/yaml.v3"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"wrapter/common"
 )
 
-// Config represents the configuration structure
+// Config represents the configuration structure. The doc and schema tags feed the JSON Schema, see Schema.
 type Config struct {
-	Tofu struct {
-		Version string `yaml:"version"`
-		Project string `yaml:"project"`
-		Region  string `yaml:"region"`
-	} `yaml:"tofu"`
+	Version           int      `yaml:"version" doc:"Configuration format version, upgrade older files with wrapter config migrate"`
+	Include           []string `yaml:"include,omitempty" doc:"Files or globs, relative to this file, merged into it; they may not redefine its values"`
+	MinWrapterVersion string   `yaml:"min_wrapter_version,omitempty" doc:"Oldest wrapter release able to use this configuration" schema:"pattern=^v?[0-9]+(\\.[0-9]+){0,2}$"`
+	Tofu              struct {
+		Version string `yaml:"version" doc:"OpenTofu version used by the repository"`
+		Project string `yaml:"project" doc:"Project name, used for the default state bucket and key prefix"`
+		Region  string `yaml:"region" doc:"Default AWS region of the project" schema:"region"`
+	} `yaml:"tofu" doc:"OpenTofu settings"`
 	CommonService struct {
-		BootstrapURL  string   `yaml:"bootstrap_url"`
-		ModuleGitURL  string   `yaml:"module_git_url"`
-		ModuleVersion string   `yaml:"module_version"`
-		Services      []string `yaml:"services"`
-	} `yaml:"common_service"`
-	DefaultRegions map[string]string `yaml:"default_regions"`
-	Profiles       struct {
-		Dev    string `yaml:"dev"`
-		Stable string `yaml:"stable"`
-		Prod   string `yaml:"prod"`
-		Mgmt   string `yaml:"mgmt"`
-	} `yaml:"profiles"`
-	Environments struct {
-		Endpoint string             `yaml:"endpoint"`
-		Dev      EnvironmentDetails `yaml:"dev"`
-		Stable   EnvironmentDetails `yaml:"stable"`
-		Prod     EnvironmentDetails `yaml:"prod"`
-		Mgmt     EnvironmentDetails `yaml:"mgmt"`
-	} `yaml:"environments"`
-
-	TerraformCliConfigPath string `yaml:"-"` // Path to the terraform.tfrc file
+		BootstrapURL  string   `yaml:"bootstrap_url" doc:"Base URL of the service templates"`
+		ModuleGitURL  string   `yaml:"module_git_url" doc:"Git source of the common service module"`
+		ModuleVersion string   `yaml:"module_version" doc:"Git ref of the common service module"`
+		Services      []string `yaml:"services" doc:"Components offered when a new service is created"`
+	} `yaml:"common_service" doc:"Common service module used to scaffold new services"`
+	Layout         string                    `yaml:"layout" doc:"Stack directory layout relative to the root, e.g. {account}/{env}/{region}/{team}/{service}"`
+	Discovery      DiscoverySettings         `yaml:"discovery" doc:"Directories batch commands such as fmt and lint discover as stacks, in addition to .wrapterignore"`
+	Regions        RegionSettings            `yaml:"regions" doc:"Region catalog extensions and per-account restrictions"`
+	DefaultRegions map[string]AccountRegions `yaml:"default_regions" doc:"Regions of each account, keyed by account ID" schema:"accounts"`
+	State          StateSettings             `yaml:"state" doc:"Global state backend settings, environments may override them"`
+	Variables      map[string]Secret         `yaml:"variables" doc:"OpenTofu input variables passed to plans as TF_VAR_<name>; values may be secret references (env:NAME, file:path, cmd:command)"`
+	Environments   map[string]Environment    `yaml:"environments" doc:"Environments keyed by name" schema:"environments"`
+
+	Root                   string            `yaml:"-"` // Repository root all stack paths are relative to
+	Origins                map[string]string `yaml:"-"` // Key path to the configuration layer that set it
+	TerraformCliConfigPath string            `yaml:"-"` // Path to the terraform.tfrc file
+
+	opts LoadOptions // Options the configuration was loaded with, see ForDir
+	dirs *dirConfigs
+}
+
+// dirConfigs caches the configurations of the directories of a repository, shared by every
+// configuration loaded with the same options
+type dirConfigs struct {
+	mu      sync.Mutex
+	configs map[string]*Config
+}
+
+// Environment describes a single named environment: the account it deploys to,
+// its state settings and the shared infrastructure details
+type Environment struct {
+	Account            string            `yaml:"account" doc:"AWS account ID the environment deploys to" schema:"account"`
+	State              StateSettings     `yaml:"state" doc:"State backend settings overriding the global ones"`
+	Variables          map[string]Secret `yaml:"variables" doc:"OpenTofu input variables overriding the global ones"`
+	EnvironmentDetails `yaml:",inline"`
 }
 
 // EnvironmentDetails captures details for each environment configuration
 type EnvironmentDetails struct {
-	AWS    string `yaml:"aws"`
-	EKS    string `yaml:"eks"`
-	Aurora string `yaml:"aurora"`
+	EKS    string `yaml:"eks" doc:"EKS cluster name"`
+	Aurora string `yaml:"aurora" doc:"Aurora cluster names"`
 	Redis  struct {
-		Host  string `yaml:"host"`
-		Group string `yaml:"group"`
-	} `yaml:"redis"`
+		Host  string `yaml:"host" doc:"Redis host"`
+		Group string `yaml:"group" doc:"Redis user group"`
+	} `yaml:"redis" doc:"Redis cluster"`
 	Atlas struct {
-		Cluster string `yaml:"cluster"`
-		Project string `yaml:"project"`
-	} `yaml:"atlas"`
+		Cluster string `yaml:"cluster" doc:"MongoDB Atlas cluster"`
+		Project string `yaml:"project" doc:"MongoDB Atlas project ID"`
+	} `yaml:"atlas" doc:"MongoDB Atlas cluster"`
 }
 
 // LoadConfig searches for the invoke.yaml file from the git root directory and loads it
+// together with the other configuration layers, see LoadOptions
 func LoadConfig(filename string) (*Config, error) {
-	gitRoot, err := common.FindGitRoot()
+	return Load(LoadOptions{Filename: filename})
+}
+
+// Load locates the configuration, merges all configuration layers and decodes the result
+func Load(opts LoadOptions) (*Config, error) {
+	root, opts, err := prepareLoad(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := load(root, opts)
+	if err != nil {
+		return nil, err
+	}
+	config.dirs = &dirConfigs{configs: map[string]*Config{opts.Dir: config}}
+	return config, nil
+}
+
+// ForDir returns the configuration applying to a directory of the repository, such as a stack
+// selected with --stack: the same layers, with the .wrapter.yaml files from the root down to
+// that directory instead of the ones above the working directory
+func (c *Config) ForDir(dir string) (*Config, error) {
+	if c.dirs == nil {
+		return c, nil // Not loaded from files
+	}
+	absDir, err := filepath.Abs(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	configPath := filepath.Join(gitRoot, filename)
+	c.dirs.mu.Lock()
+	defer c.dirs.mu.Unlock()
+	if config, exists := c.dirs.configs[absDir]; exists {
+		return config, nil
+	}
 
-	data, err := os.ReadFile(configPath)
+	opts := c.opts
+	opts.Dir = absDir
+	config, err := load(c.Root, opts)
 	if err != nil {
 		return nil, err
 	}
+	config.dirs = c.dirs
+	c.dirs.configs[absDir] = config
+	return config, nil
+}
+
+// load merges the configuration layers of located options and decodes the result
+func load(root string, opts LoadOptions) (*Config, error) {
+	merged, err := loadLayers(root, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Checked before decoding, a configuration written for a newer wrapter may not decode
+	if required := lookupKey(merged.node, "min_wrapter_version"); required != nil {
+		if err := checkWrapterVersion(required.Value); err != nil {
+			return nil, err
+		}
+	}
 
 	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
+	if err := merged.node.Decode(&config); err != nil {
+		return nil, err
+	}
+	config.Version = CurrentVersion
+
+	if _, err := config.StackLayout(); err != nil {
 		return nil, err
 	}
 
-	// Set the path to the terraform.tfrc file found in the same directory as the .git folder
-	config.TerraformCliConfigPath = filepath.Join(gitRoot, "terraform.tfrc")
+	config.Root = root
+	config.Origins = merged.origins
+	config.opts = opts
+
+	// The terraform.tfrc file is expected in the root unless another one was given
+	config.TerraformCliConfigPath = opts.CLIConfigFile
+	if config.TerraformCliConfigPath == "" {
+		config.TerraformCliConfigPath = filepath.Join(root, "terraform.tfrc")
+	}
 
 	return &config, nil
 }
+
+// Locate returns the repository root and the configuration file selected by the options:
+// an explicit configuration file, an explicit root, or discovery from the working directory.
+// Discovery uses the git root when it holds the configuration file, and otherwise walks up
+// from the working directory until a directory holding it is found.
+func Locate(opts LoadOptions) (root, file string, err error) {
+	if opts, err = withDefaults(opts); err != nil {
+		return "", "", err
+	}
+	return locate(opts)
+}
+
+// prepareLoad locates the configuration and fills in the defaults of the load options;
+// the returned options hold absolute paths
+func prepareLoad(opts LoadOptions) (string, LoadOptions, error) {
+	opts, err := withDefaults(opts)
+	if err != nil {
+		return "", opts, err
+	}
+
+	root, file, err := locate(opts)
+	if err != nil {
+		return "", opts, err
+	}
+	opts.ConfigFile = file
+	return root, opts, nil
+}
+
+// withDefaults fills in the defaults of the load options, taking unset locations from the
+// WRAPTER_CONFIG, WRAPTER_ROOT and WRAPTER_CLI_CONFIG environment variables
+func withDefaults(opts LoadOptions) (LoadOptions, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return opts, err
+	}
+
+	if opts.Filename == "" {
+		opts.Filename = "invoke.yaml"
+	}
+	if opts.Dir == "" {
+		opts.Dir = cwd
+	}
+	for _, option := range []struct {
+		value *string
+		env   string
+	}{
+		{&opts.ConfigFile, EnvConfigFile},
+		{&opts.Root, EnvRoot},
+		{&opts.CLIConfigFile, EnvCLIConfigFile},
+	} {
+		if *option.value == "" {
+			*option.value = os.Getenv(option.env)
+		}
+		if *option.value != "" && !filepath.IsAbs(*option.value) {
+			*option.value = filepath.Join(cwd, *option.value)
+		}
+	}
+
+	return opts, nil
+}
+
+// locate implements Locate on options with defaults
+func locate(opts LoadOptions) (string, string, error) {
+	switch {
+	case opts.ConfigFile != "":
+		if !isFile(opts.ConfigFile) {
+			return "", "", fmt.Errorf("configuration file %s does not exist", opts.ConfigFile)
+		}
+		if opts.Root != "" {
+			return opts.Root, opts.ConfigFile, nil
+		}
+		return filepath.Dir(opts.ConfigFile), opts.ConfigFile, nil
+
+	case opts.Root != "":
+		file := filepath.Join(opts.Root, opts.Filename)
+		if !isFile(file) {
+			return "", "", fmt.Errorf("configuration file %s does not exist in the root %s", opts.Filename, opts.Root)
+		}
+		return opts.Root, file, nil
+	}
+
+	var searched []string
+	if gitRoot, err := common.FindGitRootFrom(opts.Dir); err == nil {
+		if file := filepath.Join(gitRoot, opts.Filename); isFile(file) {
+			return gitRoot, file, nil
+		}
+		searched = append(searched, gitRoot)
+	}
+
+	for dir := opts.Dir; ; dir = filepath.Dir(dir) {
+		if file := filepath.Join(dir, opts.Filename); isFile(file) {
+			return dir, file, nil
+		}
+		if !contains(searched, dir) {
+			searched = append(searched, dir)
+		}
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+	return "", "", fmt.Errorf("could not find %s, searched: %s; use --config or --root to point at it", opts.Filename, strings.Join(searched, ", "))
+}
+
+// isFile reports whether path is an existing regular file
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// Origin returns where the value at a dotted key path was defined, e.g. "invoke.yaml:12"
+// or "env WRAPTER_STATE__ENDPOINT". Values that were never set return an empty string.
+func (c *Config) Origin(path string) string {
+	return c.Origins[path]
+}
+
+// EnvironmentNames returns the names of all configured environments in sorted order
+func (c *Config) EnvironmentNames() []string {
+	names := make([]string, 0, len(c.Environments))
+	for name := range c.Environments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Environment returns the configuration of the named environment
+func (c *Config) Environment(name string) (Environment, error) {
+	env, exists := c.Environments[name]
+	if !exists {
+		return Environment{}, fmt.Errorf("environment %q is not defined in the configuration", name)
+	}
+	if env.Account == "" {
+		return Environment{}, fmt.Errorf("environment %q has no account configured", name)
+	}
+	return env, nil
+}
+
+// StackLayout returns the parsed repository layout, falling back to DefaultLayout
+func (c *Config) StackLayout() (*Layout, error) {
+	if c.Layout == "" {
+		return ParseLayout(DefaultLayout)
+	}
+	return ParseLayout(c.Layout)
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// writeFile writes a test file, creating its directory
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForDir(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "invoke.yaml"), "version: 2\nstate:\n  bucket: shared\n")
+	ledger := filepath.Join(root, "111111111111", "prod", "us-east-1", "pay", "ledger")
+	custom := filepath.Join(root, "111111111111", "prod", "us-east-1", "pay", "ledger-custom")
+	writeFile(t, filepath.Join(ledger, DirConfigFile), "state:\n  bucket: special\n")
+	if err := os.MkdirAll(custom, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loaded from inside ledger, as when running there
+	cfg, err := Load(LoadOptions{Root: root, Dir: ledger})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		dir    string
+		bucket string
+	}{
+		{ledger, "special"},
+		{custom, "shared"},
+		{root, "shared"},
+	} {
+		dirCfg, err := cfg.ForDir(test.dir)
+		if err != nil {
+			t.Fatalf("ForDir(%s): %v", test.dir, err)
+		}
+		if dirCfg.State.Bucket != test.bucket {
+			t.Errorf("ForDir(%s): bucket %q, want %q", test.dir, dirCfg.State.Bucket, test.bucket)
+		}
+	}
+
+	again, err := cfg.ForDir(custom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first, _ := cfg.ForDir(custom); first != again {
+		t.Error("ForDir doesn't cache the configuration of a directory")
+	}
+}
+
+func TestEnvironmentLayer(t *testing.T) {
+	var lower yaml.Node
+	if err := yaml.Unmarshal([]byte("variables:\n  SERVICES_TOKEN: env:SERVICES_TOKEN\nenvironments:\n  prod:\n    account: \"111111111111\"\n"), &lower); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		variable string
+		path     string // Empty when the variable is ignored
+	}{
+		{"WRAPTER_STATE__ENDPOINT", "state.endpoint"},
+		{"WRAPTER_VARIABLES__SERVICES_TOKEN", "variables.SERVICES_TOKEN"},
+		{"WRAPTER_VARIABLES__services_token", "variables.SERVICES_TOKEN"},
+		{"WRAPTER_VARIABLES__New_Token", "variables.New_Token"},
+		{"WRAPTER_ENVIRONMENTS__PROD__STATE__BUCKET", "environments.prod.state.bucket"},
+		{"WRAPTER_ENVIRONMENTS__QA__ACCOUNT", "environments.QA.account"},
+		{"WRAPTER_DEFAULT_REGIONS__111111111111__DEFAULT", "default_regions.111111111111.default"},
+		{"WRAPTER_ENVIRONMENTS__PROD__EKS", "environments.prod.eks"},
+		{"WRAPTER_TOFU__PROJET", "tofu.projet"},
+		{"WRAPTER_TOKEN", ""},
+		{"WRAPTER_CONFIG", ""},
+		{"OTHER_STATE__ENDPOINT", ""},
+	} {
+		envLayer, err := environmentLayer([]string{test.variable + "=value"}, lower.Content[0])
+		if err != nil {
+			t.Fatalf("%s: %v", test.variable, err)
+		}
+		var paths []string
+		for path := range envLayer.origins {
+			paths = append(paths, path)
+		}
+		if test.path == "" {
+			if len(paths) > 0 {
+				t.Errorf("%s: set %v, want it ignored", test.variable, paths)
+			}
+			continue
+		}
+		if len(paths) != 1 || paths[0] != test.path || envLayer.origins[test.path] != "env "+test.variable {
+			t.Errorf("%s: set %v, want %s", test.variable, paths, test.path)
+		}
+	}
+
+	if _, err := environmentLayer([]string{"WRAPTER_STATE____ENDPOINT=value"}, lower.Content[0]); err == nil {
+		t.Error("an empty key segment was accepted")
+	}
+}
+
+func TestEnvironmentVariablesOverrideNames(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "invoke.yaml"), "variables:\n  SERVICES_TOKEN: env:SERVICES_TOKEN\n")
+	t.Setenv("WRAPTER_VARIABLES__SERVICES_TOKEN", "override")
+	t.Setenv("WRAPTER_TOKEN", "a secret")
+
+	cfg, err := Load(LoadOptions{Root: root, Dir: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Variables) != 1 || cfg.Variables["SERVICES_TOKEN"] != "override" {
+		t.Errorf("variables %v, want SERVICES_TOKEN overridden", cfg.Variables)
+	}
+	if origin := cfg.Origin("token"); origin != "" {
+		t.Errorf("WRAPTER_TOKEN was merged from %s", origin)
+	}
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Credential sources supported in state.credentials.source
+const (
+	CredentialsEnv     = "env"     // Read the keys from environment variables, the default
+	CredentialsFile    = "file"    // Read access_key/secret_key from a YAML or JSON file
+	CredentialsProfile = "profile" // Let the backend use a named AWS profile
+	CredentialsProcess = "process" // Run a credential_process style command and read its JSON output
+)
+
+// CredentialSettings describes where the state backend credentials come from
+type CredentialSettings struct {
+	Source       string `yaml:"source" doc:"Credentials source, env by default" schema:"enum=env|file|profile|process"`
+	AccessKeyEnv string `yaml:"access_key_env" doc:"env source: access key variable, MINIO_ACCESS_KEY by default"`
+	SecretKeyEnv string `yaml:"secret_key_env" doc:"env source: secret key variable, MINIO_SECRET_KEY by default"`
+	File         string `yaml:"file" doc:"file source: YAML or JSON file with access_key and secret_key, relative to the root"`
+	Profile      string `yaml:"profile" doc:"profile source: AWS profile name"`
+	Command      string `yaml:"command" doc:"process source: credential_process command, run through sh -c"`
+	AccessKey    Secret `yaml:"access_key" doc:"env source: access key or secret reference (env:NAME, file:path, cmd:command), used instead of access_key_env"`
+	SecretKey    Secret `yaml:"secret_key" doc:"env source: secret key or secret reference (env:NAME, file:path, cmd:command), used instead of secret_key_env"`
+	SessionToken Secret `yaml:"session_token" doc:"env source: optional session token or secret reference"`
+}
+
+// Credentials are the secrets a state backend authenticates with
+type Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Profile      string
+}
+
+// processOutput is the JSON document printed by a credential_process command
+type processOutput struct {
+	Version         int    `json:"Version"`
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	SessionToken    string `json:"SessionToken"`
+}
+
+// ResolveCredentials loads the backend credentials of the target from their configured source.
+// The values are registered for masking, see Mask.
+func (t *Target) ResolveCredentials() (*Credentials, error) {
+	creds, err := t.readCredentials()
+	if err != nil {
+		return nil, err
+	}
+	for _, value := range []string{creds.AccessKey, creds.SecretKey, creds.SessionToken} {
+		RegisterSecret(value)
+	}
+	return creds, nil
+}
+
+// PlaceholderCredentials stands for the backend credentials of the target without reading them,
+// for dry runs: profiles aren't secret and are kept, keys are replaced with placeholders
+func (t *Target) PlaceholderCredentials() *Credentials {
+	if t.Credentials.Source == CredentialsProfile {
+		return &Credentials{Profile: t.Credentials.Profile}
+	}
+	return &Credentials{AccessKey: "<access_key>", SecretKey: "<secret_key>"}
+}
+
+// readCredentials reads the backend credentials from their configured source
+func (t *Target) readCredentials() (*Credentials, error) {
+	settings := t.Credentials
+	switch settings.Source {
+	case "", CredentialsEnv:
+		if settings.AccessKey != "" || settings.SecretKey != "" {
+			secrets := map[string]Secret{"access_key": settings.AccessKey, "secret_key": settings.SecretKey, "session_token": settings.SessionToken}
+			values, err := resolveSecrets(secrets, t.root)
+			if err != nil {
+				return nil, err
+			}
+			return &Credentials{AccessKey: values["access_key"], SecretKey: values["secret_key"], SessionToken: values["session_token"]}, nil
+		}
+
+		accessKeyEnv, secretKeyEnv := settings.AccessKeyEnv, settings.SecretKeyEnv
+		if accessKeyEnv == "" {
+			accessKeyEnv = "MINIO_ACCESS_KEY"
+		}
+		if secretKeyEnv == "" {
+			secretKeyEnv = "MINIO_SECRET_KEY"
+		}
+		return &Credentials{AccessKey: os.Getenv(accessKeyEnv), SecretKey: os.Getenv(secretKeyEnv)}, nil
+
+	case CredentialsFile:
+		path := settings.File
+		if path == "" {
+			return nil, fmt.Errorf("credentials source %q requires a file", settings.Source)
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(t.root, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read credentials file: %w", err)
+		}
+		var file struct {
+			AccessKey    string `yaml:"access_key"`
+			SecretKey    string `yaml:"secret_key"`
+			SessionToken string `yaml:"session_token"`
+		}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("could not parse credentials file %s: %w", path, err)
+		}
+		return &Credentials{AccessKey: file.AccessKey, SecretKey: file.SecretKey, SessionToken: file.SessionToken}, nil
+
+	case CredentialsProfile:
+		if settings.Profile == "" {
+			return nil, fmt.Errorf("credentials source %q requires a profile", settings.Source)
+		}
+		return &Credentials{Profile: settings.Profile}, nil
+
+	case CredentialsProcess:
+		if settings.Command == "" {
+			return nil, fmt.Errorf("credentials source %q requires a command", settings.Source)
+		}
+		var stdout, stderr bytes.Buffer
+		command := exec.Command("sh", "-c", settings.Command)
+		command.Dir = t.root
+		command.Stdout = &stdout
+		command.Stderr = &stderr
+		if err := command.Run(); err != nil {
+			return nil, fmt.Errorf("credential process failed: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		var output processOutput
+		if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+			return nil, fmt.Errorf("could not parse credential process output: %w", err)
+		}
+		if output.Version != 1 {
+			return nil, fmt.Errorf("unsupported credential process output version %d", output.Version)
+		}
+		return &Credentials{AccessKey: output.AccessKeyID, SecretKey: output.SecretAccessKey, SessionToken: output.SessionToken}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported credentials source %q; expected one of: %s, %s, %s, %s", settings.Source, CredentialsEnv, CredentialsFile, CredentialsProfile, CredentialsProcess)
+	}
+}
+
+// awsCredentialConfig returns the s3 backend settings for the given credentials
+func awsCredentialConfig(creds *Credentials) map[string]string {
+	settings := map[string]string{}
+	if creds.Profile != "" {
+		settings["profile"] = creds.Profile
+	}
+	if creds.AccessKey != "" || creds.SecretKey != "" {
+		settings["access_key"] = creds.AccessKey
+		settings["secret_key"] = creds.SecretKey
+	}
+	if creds.SessionToken != "" {
+		settings["token"] = creds.SessionToken
+	}
+	return settings
+}
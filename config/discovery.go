@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// DiscoverySettings restricts the directories batch commands discover as stacks. Globs are
+// matched against slash separated paths relative to the root and support ** for any number of
+// directories, like .wrapterignore patterns.
+type DiscoverySettings struct {
+	Include []string `yaml:"include" doc:"Globs of the directories that may be stacks, every directory when empty"`
+	Exclude []string `yaml:"exclude" doc:"Globs of directories skipped together with everything below them"`
+}
+
+// Includes reports whether a directory, relative to the root, matches the include globs
+func (d DiscoverySettings) Includes(dir string) bool {
+	if len(d.Include) == 0 {
+		return true
+	}
+	return matchGlobs(d.Include, dir)
+}
+
+// Excludes reports whether a directory, relative to the root, or one of its parents matches
+// the exclude globs
+func (d DiscoverySettings) Excludes(dir string) bool {
+	for current := dir; current != "." && current != "/"; current = path.Dir(current) {
+		if matchGlobs(d.Exclude, current) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error for each invalid glob
+func (d DiscoverySettings) check() []error {
+	var errs []error
+	for _, glob := range append(append([]string{}, d.Include...), d.Exclude...) {
+		if _, err := GlobRegexp(glob); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// matchGlobs reports whether a path matches one of the globs, invalid globs never match
+func matchGlobs(globs []string, name string) bool {
+	for _, glob := range globs {
+		if pattern, err := GlobRegexp(glob); err == nil && pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// GlobRegexp compiles a glob matching a whole slash separated path: * and ? do not match a
+// slash, [...] is a character class ([!...] negated) and ** matches any number of directories
+// when it makes a whole path segment, anything otherwise
+func GlobRegexp(glob string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i-1] == '/'):
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid glob %q: unterminated character class", glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			sb.WriteString(regexp.QuoteMeta(glob[i+1 : i+2]))
+			i++
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	sb.WriteString("$")
+
+	pattern, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %w", glob, err)
+	}
+	return pattern, nil
+}
@@ -0,0 +1,57 @@
+package config
+
+import "testing"
+
+func TestGlobRegexp(t *testing.T) {
+	for _, test := range []struct {
+		glob    string
+		match   []string
+		noMatch []string
+	}{
+		{"**/x", []string{"x", "a/x", "a/b/x"}, []string{"xa", "a/xb", "x/a"}},
+		{"a/**/b", []string{"a/b", "a/x/b", "a/x/y/b"}, []string{"b", "ab", "a/xb", "x/a/b"}},
+		{"a/**", []string{"a/b", "a/b/c"}, []string{"a", "b/a/c"}},
+		{"*/prod/*", []string{"111111111111/prod/us-east-1"}, []string{"prod/us-east-1", "a/b/prod/c"}},
+		{"legacy-*", []string{"legacy-ledger"}, []string{"legacy", "a/legacy-ledger"}},
+		{"a?c", []string{"abc"}, []string{"a/c", "ac"}},
+		{"[a-c]x", []string{"ax", "cx"}, []string{"dx"}},
+		{"[!a-c]x", []string{"dx"}, []string{"ax"}},
+		{`\*x`, []string{"*x"}, []string{"ax"}},
+		{"a.b", []string{"a.b"}, []string{"axb"}},
+	} {
+		pattern, err := GlobRegexp(test.glob)
+		if err != nil {
+			t.Errorf("GlobRegexp(%q): %v", test.glob, err)
+			continue
+		}
+		for _, name := range test.match {
+			if !pattern.MatchString(name) {
+				t.Errorf("%q doesn't match %q", test.glob, name)
+			}
+		}
+		for _, name := range test.noMatch {
+			if pattern.MatchString(name) {
+				t.Errorf("%q matches %q", test.glob, name)
+			}
+		}
+	}
+}
+
+func TestGlobRegexpInvalid(t *testing.T) {
+	if _, err := GlobRegexp("a/[bc"); err == nil {
+		t.Error("expected an error for an unterminated character class")
+	}
+}
+
+func TestDiscoveryExcludesParents(t *testing.T) {
+	discovery := DiscoverySettings{Include: []string{"*/*/*/*/*"}, Exclude: []string{"**/legacy"}}
+	if !discovery.Excludes("111111111111/prod/legacy/pay/ledger") {
+		t.Error("a directory below an excluded one isn't excluded")
+	}
+	if discovery.Excludes("111111111111/prod/us-east-1/pay/ledger") {
+		t.Error("an unrelated directory is excluded")
+	}
+	if discovery.Includes("111111111111/prod/us-east-1/pay") {
+		t.Error("a directory not matching the include globs is included")
+	}
+}
@@ -0,0 +1,585 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration layers, from lowest to highest precedence:
+//
+//  1. invoke.yaml at the repository root, or the file given by LoadOptions.ConfigFile
+//  2. invoke.local.yaml next to it, optional and meant to be git-ignored
+//  3. .wrapter.yaml files in the directories between the root and LoadOptions.Dir, the working
+//     directory or a stack directory (see Config.ForDir), the closest one winning
+//  4. WRAPTER_* environment variables naming a configuration field, "__" separating the levels
+//     of the key path, e.g. WRAPTER_STATE__ENDPOINT or WRAPTER_ENVIRONMENTS__PROD__STATE__BUCKET
+//  5. --set key.path=value command flags, e.g. --set state.endpoint=http://localhost:9000
+//
+// Mappings are merged key by key; scalars and lists from a higher layer replace the lower value.
+// YAML anchors, aliases and merge keys are resolved within each file before merging. Files may
+// split their content with include, see readLayer; included fragments belong to the same layer.
+const (
+	LocalConfigFile = "invoke.local.yaml"
+	DirConfigFile   = ".wrapter.yaml"
+	EnvPrefix       = "WRAPTER_"
+)
+
+// Environment variables locating the configuration, they aren't part of the environment layer
+const (
+	EnvConfigFile    = EnvPrefix + "CONFIG"     // Same as LoadOptions.ConfigFile
+	EnvRoot          = EnvPrefix + "ROOT"       // Same as LoadOptions.Root
+	EnvCLIConfigFile = EnvPrefix + "CLI_CONFIG" // Same as LoadOptions.CLIConfigFile
+)
+
+// LoadOptions controls where the configuration layers are read from. Relative paths are
+// relative to the working directory.
+type LoadOptions struct {
+	Filename      string   // Configuration file name looked for by the discovery, invoke.yaml by default
+	ConfigFile    string   // Explicit configuration file, skips the discovery
+	Root          string   // Repository root the stack paths are relative to; the directory of the configuration file by default
+	CLIConfigFile string   // OpenTofu CLI configuration file, terraform.tfrc in the root by default
+	Dir           string   // Directory the discovery and the .wrapter.yaml lookup start from, the working directory by default
+	Overrides     []string // key.path=value assignments from command flags
+}
+
+// layer is a single configuration source merged into the effective configuration
+type layer struct {
+	node    *yaml.Node        // Flattened mapping node, without aliases or merge keys
+	origins map[string]string // Key path to the place the value was defined
+}
+
+// loadLayers reads and merges all configuration layers into a single mapping node
+func loadLayers(root string, opts LoadOptions) (*layer, error) {
+	layers, err := readLayers(root, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := newLayer()
+	for _, source := range layers {
+		mergeLayer(merged, source)
+	}
+	return merged, nil
+}
+
+// readLayers reads every configuration layer in precedence order, lowest first
+func readLayers(root string, opts LoadOptions) ([]*layer, error) {
+	var layers []*layer
+
+	files := []string{opts.ConfigFile, filepath.Join(filepath.Dir(opts.ConfigFile), LocalConfigFile)}
+	files = append(files, dirConfigFiles(root, opts.Dir)...)
+
+	for i, path := range files {
+		fileLayer, err := readLayer(root, path)
+		if os.IsNotExist(err) && i > 0 {
+			continue // Only the repository configuration file is mandatory
+		}
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, fileLayer)
+	}
+
+	// Variables refer to existing map keys, such as variable names, whatever their case
+	lower := newLayer()
+	for _, source := range layers {
+		mergeLayer(lower, source)
+	}
+	envLayer, err := environmentLayer(os.Environ(), lower.node)
+	if err != nil {
+		return nil, err
+	}
+	layers = append(layers, envLayer)
+
+	overrideLayer := newLayer()
+	for _, override := range opts.Overrides {
+		path, value, found := strings.Cut(override, "=")
+		if !found || path == "" {
+			return nil, fmt.Errorf("invalid override %q, expected key.path=value", override)
+		}
+		setPath(overrideLayer, strings.Split(path, "."), value, "--set "+path)
+	}
+	layers = append(layers, overrideLayer)
+
+	return layers, nil
+}
+
+// newLayer returns an empty layer
+func newLayer() *layer {
+	return &layer{node: &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}, origins: map[string]string{}}
+}
+
+// dirConfigFiles returns the .wrapter.yaml candidates from the root down to dir
+func dirConfigFiles(root, dir string) []string {
+	relPath, err := filepath.Rel(root, dir)
+	if err != nil || relPath == "." || strings.HasPrefix(relPath, "..") {
+		return []string{filepath.Join(root, DirConfigFile)}
+	}
+
+	files := []string{filepath.Join(root, DirConfigFile)}
+	current := root
+	for _, segment := range strings.Split(relPath, string(filepath.Separator)) {
+		current = filepath.Join(current, segment)
+		files = append(files, filepath.Join(current, DirConfigFile))
+	}
+	return files
+}
+
+// readLayer parses a configuration file and the fragments it includes into a single flattened
+// layer. Fragments are merged in include order, globs expanding in lexical order; a value defined
+// by more than one of the files is a conflict since neither should silently win.
+func readLayer(root, path string) (*layer, error) {
+	return readIncludes(root, path, nil)
+}
+
+// readIncludes reads a configuration file and, recursively, its includes; parents are the
+// including files, used to detect include cycles
+func readIncludes(root, path string, parents []string) (*layer, error) {
+	name := relativeName(root, path)
+	if contains(parents, path) {
+		var chain []string
+		for _, parent := range append(parents, path) {
+			chain = append(chain, relativeName(root, parent))
+		}
+		return nil, fmt.Errorf("include cycle: %s", strings.Join(chain, " -> "))
+	}
+
+	result, patterns, err := readFile(path, name)
+	if err != nil {
+		return nil, err
+	}
+
+	included := map[string]bool{}
+	for _, pattern := range patterns {
+		files, err := includeFiles(filepath.Dir(path), pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		for _, file := range files {
+			if included[file] {
+				continue
+			}
+			included[file] = true
+
+			fragment, err := readIncludes(root, file, append(parents, path))
+			if err != nil {
+				return nil, err
+			}
+			if err := mergeFragment(result, result.node, fragment, fragment.node, ""); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// readFile parses a single configuration file into a flattened layer, origins refer to it by
+// name. The include patterns are returned separately and removed from the layer.
+func readFile(path, name string) (*layer, []string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	result := newLayer()
+	if len(document.Content) == 0 {
+		return result, nil, nil // Empty file
+	}
+
+	// Older formats are upgraded in memory, the version only describes the file so it isn't merged
+	if _, err := Migrate(&document); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	deleteKey(document.Content[0], "version")
+
+	var patterns []string
+	if include := lookupKey(document.Content[0], "include"); include != nil {
+		include = resolveAlias(include)
+		if include.Kind != yaml.SequenceNode {
+			return nil, nil, fmt.Errorf("%s:%d: include must be a list of files or globs", name, include.Line)
+		}
+		for _, item := range include.Content {
+			if item = resolveAlias(item); item.Kind != yaml.ScalarNode || item.Value == "" {
+				return nil, nil, fmt.Errorf("%s:%d: include must be a list of files or globs", name, item.Line)
+			}
+			patterns = append(patterns, item.Value)
+		}
+		deleteKey(document.Content[0], "include")
+	}
+
+	node := flatten(document.Content[0], name, "", result.origins)
+	if node.Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("%s: top level must be a mapping", path)
+	}
+	result.node = node
+	return result, patterns, nil
+}
+
+// includeFiles expands an include pattern relative to dir. A glob may match nothing, a plain
+// file name must exist.
+func includeFiles(dir, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include pattern %q: %w", pattern, err)
+	}
+	if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("included file %s does not exist", pattern)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// mergeFragment merges an included fragment into the including layer, failing on any value
+// defined by both of them
+func mergeFragment(dst *layer, dstNode *yaml.Node, src *layer, srcNode *yaml.Node, path string) error {
+	for i := 0; i < len(srcNode.Content); i += 2 {
+		key, value := srcNode.Content[i], srcNode.Content[i+1]
+		childPath := joinPath(path, key.Value)
+
+		existing := lookupKey(dstNode, key.Value)
+		if existing == nil {
+			setKeyNode(dstNode, key, copyNode(value))
+			for originPath, origin := range src.origins {
+				if originPath == childPath || strings.HasPrefix(originPath, childPath+".") {
+					dst.origins[originPath] = origin
+				}
+			}
+			continue
+		}
+		if existing.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+			if err := mergeFragment(dst, existing, src, value, childPath); err != nil {
+				return err
+			}
+			continue
+		}
+		return fmt.Errorf("conflicting configuration for %s: defined in %s and in %s", childPath, dst.originNear(childPath), src.originNear(childPath))
+	}
+	return nil
+}
+
+// relativeName returns the path of a configuration file relative to the root, used in origins
+func relativeName(root, path string) string {
+	name, err := filepath.Rel(root, path)
+	if err != nil || strings.HasPrefix(name, "..") {
+		return path
+	}
+	return name
+}
+
+// originNear returns the origin of a key path in the layer, of its closest defined parent, or of
+// the first value defined below it
+func (l *layer) originNear(path string) string {
+	for current := path; current != ""; {
+		if origin, exists := l.origins[current]; exists {
+			return origin
+		}
+		i := strings.LastIndex(current, ".")
+		if i < 0 {
+			break
+		}
+		current = current[:i]
+	}
+	for _, originPath := range sortedKeys(l.origins) {
+		if strings.HasPrefix(originPath, path+".") {
+			return l.origins[originPath]
+		}
+	}
+	return ""
+}
+
+// environmentLayer builds a layer from the WRAPTER_* environment variables whose first segment
+// names a configuration field; others, such as secrets read through env:WRAPTER_TOKEN, are
+// ignored. lower is the merged configuration of the lower layers, see environmentPath.
+func environmentLayer(environ []string, lower *yaml.Node) (*layer, error) {
+	result := newLayer()
+
+	sort.Strings(environ)
+	for _, entry := range environ {
+		name, value, _ := strings.Cut(entry, "=")
+		if !strings.HasPrefix(name, EnvPrefix) || name == EnvConfigFile || name == EnvRoot || name == EnvCLIConfigFile {
+			continue
+		}
+
+		segments := strings.Split(strings.TrimPrefix(name, EnvPrefix), "__")
+		path, ok := environmentPath(segments, lower)
+		if !ok {
+			continue
+		}
+		if contains(segments, "") {
+			return nil, fmt.Errorf("invalid configuration variable %s", name)
+		}
+		setPath(result, path, value, "env "+name)
+	}
+
+	return result, nil
+}
+
+// environmentPath turns the segments of a variable name into a key path following the Config
+// type. Segments naming struct fields are lower-cased, while map keys, such as variable and
+// environment names, keep their case unless they match a key of lower ignoring case. It
+// reports false when the first segment names no field.
+func environmentPath(segments []string, lower *yaml.Node) ([]string, bool) {
+	t := reflect.TypeOf(Config{})
+	node := lower
+	path := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		key := strings.ToLower(segment)
+		switch {
+		case t != nil && t.Kind() == reflect.Struct:
+			t = fieldType(t, key)
+			if t == nil && i == 0 {
+				return nil, false
+			}
+		case t != nil && t.Kind() == reflect.Map:
+			key = segment
+			if node != nil {
+				for j := 0; j < len(node.Content); j += 2 {
+					if strings.EqualFold(node.Content[j].Value, segment) {
+						key = node.Content[j].Value
+						break
+					}
+				}
+			}
+			t = t.Elem()
+		default:
+			t = nil // Below a scalar or an unknown field, which validation reports
+		}
+		path = append(path, key)
+
+		if node != nil {
+			if node = lookupKey(node, key); node != nil && node.Kind != yaml.MappingNode {
+				node = nil
+			}
+		}
+	}
+	return path, true
+}
+
+// fieldType returns the type of the field of a struct type named key by its yaml tag, looking
+// into inline fields, or nil
+func fieldType(t reflect.Type, key string) reflect.Type {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if strings.Contains(field.Tag.Get("yaml"), ",inline") {
+			if inline := fieldType(field.Type, key); inline != nil {
+				return inline
+			}
+			continue
+		}
+		if name == key && name != "-" && field.IsExported() {
+			return field.Type
+		}
+	}
+	return nil
+}
+
+// setPath sets a value in a layer, creating the intermediate mappings. The value is parsed as
+// YAML so lists and mappings can be given inline; anything unparsable is kept as a string.
+func setPath(target *layer, segments []string, value, origin string) {
+	valueNode := &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+	var document yaml.Node
+	if err := yaml.Unmarshal([]byte(value), &document); err == nil && len(document.Content) == 1 {
+		valueNode = flatten(document.Content[0], origin, "", map[string]string{})
+	}
+
+	current := target.node
+	for i, segment := range segments {
+		if i == len(segments)-1 {
+			setKey(current, segment, valueNode)
+			break
+		}
+		child := lookupKey(current, segment)
+		if child == nil || child.Kind != yaml.MappingNode {
+			child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			setKey(current, segment, child)
+		}
+		current = child
+	}
+
+	path := strings.Join(segments, ".")
+	clearOrigins(target.origins, path)
+	target.origins[path] = origin
+}
+
+// flatten returns a copy of the node with aliases and merge keys resolved, recording
+// the origin of every scalar and list below path
+func flatten(node *yaml.Node, source, path string, origins map[string]string) *yaml.Node {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		return flatten(node.Content[0], source, path, origins)
+
+	case yaml.AliasNode:
+		return flatten(node.Alias, source, path, origins)
+
+	case yaml.SequenceNode:
+		result := &yaml.Node{Kind: node.Kind, Tag: node.Tag, Style: node.Style, Line: node.Line, Column: node.Column}
+		for _, item := range node.Content {
+			result.Content = append(result.Content, flatten(item, source, "", map[string]string{}))
+		}
+		origins[path] = fmt.Sprintf("%s:%d", source, node.Line)
+		return result
+
+	case yaml.MappingNode:
+		result := &yaml.Node{Kind: node.Kind, Tag: node.Tag, Style: node.Style, Line: node.Line, Column: node.Column}
+
+		// Merge keys are applied first so that explicit keys override them. Within a list of
+		// merged mappings the earlier ones take precedence, so they are applied last.
+		for i := 0; i < len(node.Content); i += 2 {
+			if !isMergeKey(node.Content[i]) {
+				continue
+			}
+			sources := []*yaml.Node{node.Content[i+1]}
+			if resolved := resolveAlias(node.Content[i+1]); resolved.Kind == yaml.SequenceNode {
+				sources = resolved.Content
+			}
+			for j := len(sources) - 1; j >= 0; j-- {
+				merged := flatten(sources[j], source, path, map[string]string{})
+				for k := 0; k < len(merged.Content); k += 2 {
+					childPath := joinPath(path, merged.Content[k].Value)
+					clearOrigins(origins, childPath)
+					setKeyNode(result, merged.Content[k], flatten(merged.Content[k+1], source, childPath, origins))
+				}
+			}
+		}
+
+		for i := 0; i < len(node.Content); i += 2 {
+			if isMergeKey(node.Content[i]) {
+				continue
+			}
+			childPath := joinPath(path, node.Content[i].Value)
+			clearOrigins(origins, childPath)
+			setKeyNode(result, node.Content[i], flatten(node.Content[i+1], source, childPath, origins))
+		}
+
+		if len(result.Content) == 0 {
+			origins[path] = fmt.Sprintf("%s:%d", source, node.Line)
+		}
+		return result
+
+	default:
+		result := *node
+		result.Anchor = ""
+		if path != "" {
+			origins[path] = fmt.Sprintf("%s:%d", source, node.Line)
+		}
+		return &result
+	}
+}
+
+// mergeLayer merges the source layer into the destination layer
+func mergeLayer(dst, src *layer) {
+	mergeMapping(dst, dst.node, src, src.node, "")
+}
+
+// mergeMapping merges the keys of the source mapping into the destination mapping
+func mergeMapping(dst *layer, dstNode *yaml.Node, src *layer, srcNode *yaml.Node, path string) {
+	for i := 0; i < len(srcNode.Content); i += 2 {
+		key, value := srcNode.Content[i].Value, srcNode.Content[i+1]
+		childPath := joinPath(path, key)
+
+		existing := lookupKey(dstNode, key)
+		if existing != nil && existing.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+			mergeMapping(dst, existing, src, value, childPath)
+			continue
+		}
+
+		// Copy the value so that merging further layers never modifies the source layer
+		setKey(dstNode, key, copyNode(value))
+		clearOrigins(dst.origins, childPath)
+		for originPath, origin := range src.origins {
+			if originPath == childPath || strings.HasPrefix(originPath, childPath+".") {
+				dst.origins[originPath] = origin
+			}
+		}
+	}
+}
+
+// resolveAlias follows alias nodes to the node they refer to
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
+
+// isMergeKey reports whether a mapping key is the YAML merge key "<<"
+func isMergeKey(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.Value == "<<" && (node.Tag == "!!merge" || node.Tag == "")
+}
+
+// lookupKey returns the value of a key in a mapping node, or nil
+func lookupKey(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setKey sets or replaces the value of a key in a mapping node
+func setKey(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+// setKeyNode sets or replaces the value of a key in a mapping node, keeping the position of the
+// key node so that problems can be reported on its line
+func setKeyNode(mapping *yaml.Node, key *yaml.Node, value *yaml.Node) {
+	for i := 0; i < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key.Value {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	keyNode := *resolveAlias(key)
+	keyNode.Anchor = ""
+	mapping.Content = append(mapping.Content, &keyNode, value)
+}
+
+// copyNode returns a deep copy of a flattened node
+func copyNode(node *yaml.Node) *yaml.Node {
+	result := *node
+	result.Content = nil
+	for _, child := range node.Content {
+		result.Content = append(result.Content, copyNode(child))
+	}
+	return &result
+}
+
+// clearOrigins removes the recorded origins of a key path and everything below it
+func clearOrigins(origins map[string]string, path string) {
+	for originPath := range origins {
+		if originPath == path || strings.HasPrefix(originPath, path+".") {
+			delete(origins, originPath)
+		}
+	}
+}
+
+// joinPath appends a key to a dotted key path
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,246 @@
+package config
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLayerPrecedence(t *testing.T) {
+	// Each layer sets tofu.project, layers are added from the lowest to the highest
+	layers := []struct {
+		name   string
+		add    func(t *testing.T, root, dir string) []string
+		origin string
+	}{
+		{"invoke.yaml", func(t *testing.T, root, dir string) []string {
+			writeFile(t, filepath.Join(root, "invoke.yaml"), "version: 2\ntofu:\n  project: invoke.yaml\n")
+			return nil
+		}, "invoke.yaml:3"},
+		{"invoke.local.yaml", func(t *testing.T, root, dir string) []string {
+			writeFile(t, filepath.Join(root, LocalConfigFile), "tofu:\n  project: invoke.local.yaml\n")
+			return nil
+		}, "invoke.local.yaml:2"},
+		{"root .wrapter.yaml", func(t *testing.T, root, dir string) []string {
+			writeFile(t, filepath.Join(root, DirConfigFile), "tofu:\n  project: root .wrapter.yaml\n")
+			return nil
+		}, ".wrapter.yaml:2"},
+		{"stack .wrapter.yaml", func(t *testing.T, root, dir string) []string {
+			writeFile(t, filepath.Join(dir, DirConfigFile), "\ntofu:\n  project: stack .wrapter.yaml\n")
+			return nil
+		}, "stacks/ledger/.wrapter.yaml:3"},
+		{"environment", func(t *testing.T, root, dir string) []string {
+			t.Setenv("WRAPTER_TOFU__PROJECT", "environment")
+			return nil
+		}, "env WRAPTER_TOFU__PROJECT"},
+		{"--set", func(t *testing.T, root, dir string) []string {
+			return []string{"tofu.project=--set"}
+		}, "--set tofu.project"},
+	}
+
+	for n := 1; n <= len(layers); n++ {
+		top := layers[n-1]
+		t.Run(top.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "stacks", "ledger")
+			var overrides []string
+			for _, layer := range layers[:n] {
+				overrides = append(overrides, layer.add(t, root, dir)...)
+			}
+			writeFile(t, filepath.Join(dir, "main.tf"), "")
+
+			cfg, err := Load(LoadOptions{Root: root, Dir: dir, Overrides: overrides})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Tofu.Project != top.name {
+				t.Errorf("project %q, want %q", cfg.Tofu.Project, top.name)
+			}
+			if origin := cfg.Origin("tofu.project"); origin != top.origin {
+				t.Errorf("origin %q, want %q", origin, top.origin)
+			}
+		})
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	for _, test := range []struct {
+		override string
+		check    func(cfg *Config) interface{}
+		want     interface{}
+	}{
+		{"tofu.version=1.10", func(cfg *Config) interface{} { return cfg.Tofu.Version }, "1.10"},
+		{"tofu.version=1.8", func(cfg *Config) interface{} { return cfg.Tofu.Version }, "1.8"},
+		{"common_service.services=[PostgreSQL, Mongo]", func(cfg *Config) interface{} { return cfg.CommonService.Services }, []string{"PostgreSQL", "Mongo"}},
+		{"variables.SERVICES_TOKEN=env:SERVICES_TOKEN", func(cfg *Config) interface{} { return string(cfg.Variables["SERVICES_TOKEN"]) }, "env:SERVICES_TOKEN"},
+		{"environments.prod.account=111111111111", func(cfg *Config) interface{} { return cfg.Environments["prod"].Account }, "111111111111"},
+		{"state.options.use_lockfile=true", func(cfg *Config) interface{} { return cfg.State.Options["use_lockfile"] }, "true"},
+		{"tofu.project=[unbalanced", func(cfg *Config) interface{} { return cfg.Tofu.Project }, "[unbalanced"},
+		{"tofu.project=", func(cfg *Config) interface{} { return cfg.Tofu.Project }, ""},
+	} {
+		root := t.TempDir()
+		writeFile(t, filepath.Join(root, "invoke.yaml"), "version: 2\ntofu:\n  project: company\n  version: 1.8\n")
+		cfg, err := Load(LoadOptions{Root: root, Dir: root, Overrides: []string{test.override}})
+		if err != nil {
+			t.Errorf("--set %s: %v", test.override, err)
+			continue
+		}
+		if got := test.check(cfg); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("--set %s: got %#v, want %#v", test.override, got, test.want)
+		}
+	}
+
+	for _, override := range []string{"tofu.project", "=value"} {
+		root := t.TempDir()
+		writeFile(t, filepath.Join(root, "invoke.yaml"), "version: 2\n")
+		if _, err := Load(LoadOptions{Root: root, Dir: root, Overrides: []string{override}}); err == nil {
+			t.Errorf("--set %s was accepted", override)
+		}
+	}
+}
+
+func TestOrigins(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "invoke.yaml"), `version: 2
+tofu:
+  project: company
+common_service:
+  services: [PostgreSQL, Mongo]
+environments:
+  dev: &dev
+    account: "222222222222"
+    eks: dev-cluster
+  stable:
+    <<: *dev
+    eks: stable-cluster
+`)
+	t.Setenv("WRAPTER_ENVIRONMENTS__DEV__ATLAS__CLUSTER", "shared")
+	cfg, err := Load(LoadOptions{Root: root, Dir: root, Overrides: []string{"state.endpoint=http://minio:9000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"tofu.project":                   "invoke.yaml:3",
+		"common_service.services":        "invoke.yaml:5",
+		"environments.dev.account":       "invoke.yaml:8",
+		"environments.stable.account":    "invoke.yaml:8", // Merged from the anchor
+		"environments.stable.eks":        "invoke.yaml:12",
+		"environments.dev.atlas.cluster": "env WRAPTER_ENVIRONMENTS__DEV__ATLAS__CLUSTER",
+		"state.endpoint":                 "--set state.endpoint",
+		"version":                        "",
+		"tofu.version":                   "",
+	} {
+		if origin := cfg.Origin(path); origin != want {
+			t.Errorf("Origin(%s) = %q, want %q", path, origin, want)
+		}
+	}
+	// Mappings are located by the first value below them
+	if origin := cfg.OriginNear("environments.stable"); origin != "invoke.yaml:8" {
+		t.Errorf("OriginNear(environments.stable) = %q", origin)
+	}
+}
+
+func TestIncludeOrder(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "invoke.yaml"), "version: 2\ninclude: [envs/*.yaml, extra.yaml]\ntofu:\n  project: company\n")
+	// Written out of order, expanded in lexical order
+	for _, name := range []string{"stable", "dev", "prod"} {
+		writeFile(t, filepath.Join(root, "envs", name+".yaml"), "environments:\n  "+name+":\n    eks: "+name+"-cluster\n")
+	}
+	writeFile(t, filepath.Join(root, "extra.yaml"), "include: [envs/more/*.yaml]\ndefault_regions:\n  \"111111111111\": us-east-1\n")
+	writeFile(t, filepath.Join(root, "envs", "more", "mgmt.yaml"), "environments:\n  mgmt:\n    eks: mgmt-cluster\n")
+
+	for i := 0; i < 3; i++ {
+		fileLayer, err := readLayer(root, filepath.Join(root, "invoke.yaml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		environments := lookupKey(fileLayer.node, "environments")
+		var names []string
+		for j := 0; j < len(environments.Content); j += 2 {
+			names = append(names, environments.Content[j].Value)
+		}
+		if want := []string{"dev", "prod", "stable", "mgmt"}; !reflect.DeepEqual(names, want) {
+			t.Fatalf("environments merged in the order %v, want %v", names, want)
+		}
+		if origin := fileLayer.origins["environments.mgmt.eks"]; origin != "envs/more/mgmt.yaml:3" {
+			t.Errorf("origin of a nested fragment value %q", origin)
+		}
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		files map[string]string
+		error string
+	}{
+		{
+			name: "cycle",
+			files: map[string]string{
+				"invoke.yaml": "include: [envs/a.yaml]\n",
+				"envs/a.yaml": "include: [b.yaml]\n",
+				"envs/b.yaml": "include: [../invoke.yaml]\n",
+			},
+			error: "include cycle: invoke.yaml -> envs/a.yaml -> envs/b.yaml -> invoke.yaml",
+		},
+		{
+			name: "self",
+			files: map[string]string{
+				"invoke.yaml": "include: [invoke.yaml]\n",
+			},
+			error: "include cycle: invoke.yaml -> invoke.yaml",
+		},
+		{
+			name: "fragments",
+			files: map[string]string{
+				"invoke.yaml": "include: [envs/*.yaml]\n",
+				"envs/a.yaml": "tofu:\n  project: a\n",
+				"envs/b.yaml": "tofu:\n  project: b\n",
+			},
+			error: "envs/b.yaml:2",
+		},
+		{
+			name: "including file",
+			files: map[string]string{
+				"invoke.yaml": "include: [envs/a.yaml]\ntofu:\n  project: company\n",
+				"envs/a.yaml": "tofu:\n  project: a\n",
+			},
+			error: "invoke.yaml:3",
+		},
+		{
+			name: "missing file",
+			files: map[string]string{
+				"invoke.yaml": "include: [envs/missing.yaml]\n",
+			},
+			error: "included file",
+		},
+		{
+			name: "not a list",
+			files: map[string]string{
+				"invoke.yaml": "include: envs/*.yaml\n",
+			},
+			error: "include must be a list of files or globs",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			for name, content := range test.files {
+				writeFile(t, filepath.Join(root, filepath.FromSlash(name)), content)
+			}
+			_, err := readLayer(root, filepath.Join(root, "invoke.yaml"))
+			if err == nil || !strings.Contains(err.Error(), test.error) {
+				t.Errorf("error %v, want one containing %q", err, test.error)
+			}
+		})
+	}
+
+	// A glob matching nothing is fine
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "invoke.yaml"), "include: [envs/*.yaml]\n")
+	if _, err := readLayer(root, filepath.Join(root, "invoke.yaml")); err != nil {
+		t.Errorf("empty glob: %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultLayout is the repository layout used when invoke.yaml doesn't declare one
+const DefaultLayout = "{account}/{env}/{region}/{team}/{service}"
+
+// Layout placeholders
+const (
+	placeholderAccount = "account"
+	placeholderEnv     = "env"
+	placeholderRegion  = "region"
+	placeholderTeam    = "team"
+	placeholderService = "service"
+)
+
+// Location holds the values of the layout placeholders for a single stack
+type Location struct {
+	Account     string
+	Environment string
+	Region      string
+	Team        string
+	Service     string
+}
+
+// Layout describes how stack directories are laid out relative to the repository root,
+// e.g. "{account}/{env}/{region}/{team}/{service}"
+type Layout struct {
+	pattern  string
+	segments []string // Each segment is either a literal or a placeholder name wrapped in braces
+}
+
+// ParseLayout parses and validates a layout pattern
+func ParseLayout(pattern string) (*Layout, error) {
+	clean := strings.Trim(filepath.ToSlash(pattern), "/")
+	if clean == "" {
+		return nil, fmt.Errorf("layout pattern is empty")
+	}
+
+	layout := &Layout{pattern: clean, segments: strings.Split(clean, "/")}
+	seen := map[string]bool{}
+	for _, segment := range layout.segments {
+		name, isPlaceholder := placeholderName(segment)
+		if !isPlaceholder {
+			if strings.ContainsAny(segment, "{}") {
+				return nil, fmt.Errorf("layout %q: segment %q must be a literal or a single placeholder", pattern, segment)
+			}
+			continue
+		}
+		switch name {
+		case placeholderAccount, placeholderEnv, placeholderRegion, placeholderTeam, placeholderService:
+		default:
+			return nil, fmt.Errorf("layout %q: unknown placeholder {%s}", pattern, name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("layout %q: placeholder {%s} is used more than once", pattern, name)
+		}
+		seen[name] = true
+	}
+
+	// The environment is needed to resolve a stack, team and service to scaffold one
+	for _, required := range []string{placeholderEnv, placeholderTeam, placeholderService} {
+		if !seen[required] {
+			return nil, fmt.Errorf("layout %q: placeholder {%s} is required", pattern, required)
+		}
+	}
+
+	return layout, nil
+}
+
+// String returns the layout pattern
+func (l *Layout) String() string {
+	return l.pattern
+}
+
+// Has reports whether the layout contains the named placeholder
+func (l *Layout) Has(name string) bool {
+	for _, segment := range l.segments {
+		if placeholder, ok := placeholderName(segment); ok && placeholder == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse extracts the placeholder values from a stack path relative to the repository root
+func (l *Layout) Parse(relPath string) (*Location, error) {
+	clean := filepath.ToSlash(filepath.Clean(relPath))
+	parts := strings.Split(clean, "/")
+	if clean == "." || len(parts) != len(l.segments) {
+		return nil, fmt.Errorf("path %s does not match layout %s", relPath, l.pattern)
+	}
+
+	location := &Location{}
+	for i, segment := range l.segments {
+		name, isPlaceholder := placeholderName(segment)
+		if !isPlaceholder {
+			if parts[i] != segment {
+				return nil, fmt.Errorf("path %s does not match layout %s: expected %q, found %q", relPath, l.pattern, segment, parts[i])
+			}
+			continue
+		}
+		*location.field(name) = parts[i]
+	}
+
+	return location, nil
+}
+
+// Format builds the stack path relative to the repository root for the given location
+func (l *Layout) Format(location *Location) (string, error) {
+	return formatSegments(l.segments, location)
+}
+
+// FormatPrefix builds the path of the directory holding the named placeholder, e.g. the team
+// directory for "team", relative to the repository root
+func (l *Layout) FormatPrefix(location *Location, name string) (string, error) {
+	for i, segment := range l.segments {
+		if placeholder, ok := placeholderName(segment); ok && placeholder == name {
+			return formatSegments(l.segments[:i+1], location)
+		}
+	}
+	return "", fmt.Errorf("layout %s has no placeholder {%s}", l.pattern, name)
+}
+
+// formatSegments builds a path from layout segments and the values of their placeholders
+func formatSegments(segments []string, location *Location) (string, error) {
+	parts := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		name, isPlaceholder := placeholderName(segment)
+		if !isPlaceholder {
+			parts = append(parts, segment)
+			continue
+		}
+		value := *location.field(name)
+		if value == "" || strings.ContainsAny(value, `/\`) {
+			return "", fmt.Errorf("invalid value %q for layout placeholder {%s}", value, name)
+		}
+		parts = append(parts, value)
+	}
+	return filepath.Join(parts...), nil
+}
+
+// field returns a pointer to the location field backing the named placeholder
+func (loc *Location) field(name string) *string {
+	switch name {
+	case placeholderAccount:
+		return &loc.Account
+	case placeholderEnv:
+		return &loc.Environment
+	case placeholderRegion:
+		return &loc.Region
+	case placeholderTeam:
+		return &loc.Team
+	default:
+		return &loc.Service
+	}
+}
+
+// placeholderName returns the placeholder name of a layout segment such as "{env}"
+func placeholderName(segment string) (string, bool) {
+	if len(segment) > 2 && strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+		return segment[1 : len(segment)-1], true
+	}
+	return "", false
+}
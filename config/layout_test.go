@@ -0,0 +1,124 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseLayout(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		err     string
+	}{
+		{DefaultLayout, ""},
+		{"/{env}/{team}/{service}/", ""},
+		{"{account}/{env}/{team}/{service}/{region}", ""},
+		{"stacks/{env}/{team}/{service}", ""},
+		{"", "empty"},
+		{"{env}/{team}", "{service} is required"},
+		{"{env}/{team}/{service}/{env}", "used more than once"},
+		{"{env}/{team}/{service}/{stage}", "unknown placeholder"},
+		{"{env}/{team}-x/{service}", "single placeholder"},
+	} {
+		_, err := ParseLayout(test.pattern)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("ParseLayout(%q): %v", test.pattern, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("ParseLayout(%q) error %v, want %q", test.pattern, err, test.err)
+		}
+	}
+}
+
+func TestLayoutParseAndFormat(t *testing.T) {
+	for _, test := range []struct {
+		pattern  string
+		path     string
+		location Location
+	}{
+		{DefaultLayout, "111111111111/prod/us-east-1/pay/ledger", Location{"111111111111", "prod", "us-east-1", "pay", "ledger"}},
+		{"{account}/{env}/{team}/{service}/{region}", "111111111111/prod/pay/ledger/us-east-1", Location{"111111111111", "prod", "us-east-1", "pay", "ledger"}},
+		{"stacks/{env}/{team}/{service}", "stacks/prod/pay/ledger", Location{Environment: "prod", Team: "pay", Service: "ledger"}},
+	} {
+		layout, err := ParseLayout(test.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		location, err := layout.Parse(filepath.FromSlash(test.path))
+		if err != nil {
+			t.Errorf("%s: Parse(%s): %v", test.pattern, test.path, err)
+			continue
+		}
+		if *location != test.location {
+			t.Errorf("%s: Parse(%s) = %+v, want %+v", test.pattern, test.path, *location, test.location)
+		}
+
+		path, err := layout.Format(&test.location)
+		if err != nil || path != filepath.FromSlash(test.path) {
+			t.Errorf("%s: Format(%+v) = %s, %v, want %s", test.pattern, test.location, path, err, test.path)
+		}
+	}
+}
+
+func TestLayoutParseMismatch(t *testing.T) {
+	layout, err := ParseLayout("stacks/{env}/{team}/{service}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{".", "stacks/prod/pay", "stacks/prod/pay/ledger/extra", "other/prod/pay/ledger"} {
+		if location, err := layout.Parse(path); err == nil {
+			t.Errorf("Parse(%s) = %+v, want an error", path, *location)
+		}
+	}
+}
+
+func TestLayoutFormatInvalidValue(t *testing.T) {
+	layout, err := ParseLayout(DefaultLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, location := range []Location{
+		{"111111111111", "prod", "us-east-1", "pay", ""},
+		{"111111111111", "prod", "us-east-1", "pay/x", "ledger"},
+	} {
+		if path, err := layout.Format(&location); err == nil {
+			t.Errorf("Format(%+v) = %s, want an error", location, path)
+		}
+	}
+}
+
+func TestStackDirAndTeamDir(t *testing.T) {
+	target := &Target{AccountID: "111111111111", Environment: "prod", Region: "us-east-1"}
+	for _, test := range []struct {
+		layout  string
+		stack   string
+		custom  string
+		teamDir string
+	}{
+		{"", "111111111111/prod/us-east-1/pay/ledger", "111111111111/prod/us-east-1/pay/ledger-custom", "111111111111/prod/us-east-1/pay"},
+		{"{account}/{env}/{team}/{service}/{region}", "111111111111/prod/pay/ledger/us-east-1", "111111111111/prod/pay/ledger-custom/us-east-1", "111111111111/prod/pay"},
+		{"{team}/{service}/{env}", "pay/ledger/prod", "pay/ledger-custom/prod", "pay"},
+	} {
+		resolver := NewResolver(&Config{Root: "/repo", Layout: test.layout})
+
+		for _, check := range []struct {
+			service string
+			want    string
+		}{
+			{"ledger", test.stack},
+			{"ledger-custom", test.custom},
+		} {
+			dir, err := resolver.StackDir(target, "pay", check.service)
+			if want := filepath.Join("/repo", filepath.FromSlash(check.want)); err != nil || dir != want {
+				t.Errorf("%q: StackDir(%s) = %s, %v, want %s", test.layout, check.service, dir, err, want)
+			}
+		}
+
+		dir, err := resolver.TeamDir(target, "pay")
+		if want := filepath.Join("/repo", filepath.FromSlash(test.teamDir)); err != nil || dir != want {
+			t.Errorf("%q: TeamDir() = %s, %v, want %s", test.layout, dir, err, want)
+		}
+	}
+}
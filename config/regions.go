@@ -0,0 +1,129 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// awsRegions is the built-in catalog of AWS region codes. invoke.yaml can extend it through regions.extra.
+var awsRegions = []string{
+	"af-south-1",
+	"ap-east-1",
+	"ap-northeast-1", "ap-northeast-2", "ap-northeast-3",
+	"ap-south-1", "ap-south-2",
+	"ap-southeast-1", "ap-southeast-2", "ap-southeast-3", "ap-southeast-4", "ap-southeast-5", "ap-southeast-7",
+	"ca-central-1", "ca-west-1",
+	"cn-north-1", "cn-northwest-1",
+	"eu-central-1", "eu-central-2",
+	"eu-north-1",
+	"eu-south-1", "eu-south-2",
+	"eu-west-1", "eu-west-2", "eu-west-3",
+	"il-central-1",
+	"me-central-1", "me-south-1",
+	"mx-central-1",
+	"sa-east-1",
+	"us-east-1", "us-east-2",
+	"us-gov-east-1", "us-gov-west-1",
+	"us-west-1", "us-west-2",
+}
+
+// RegionSettings extends the built-in region catalog and restricts the regions of individual accounts
+type RegionSettings struct {
+	Extra   []string            `yaml:"extra" doc:"Additional region codes, e.g. for S3-compatible stores or new AWS regions" schema:"pattern=^[a-z0-9]+(-[a-z0-9]+)*$"`
+	Allowed map[string][]string `yaml:"allowed" doc:"Regions the stacks of each account may use, keyed by account ID" schema:"accounts,regions"`
+}
+
+// AccountRegions lists the regions an account deploys to and the one used when none is chosen.
+// In invoke.yaml it is either a plain region string or a mapping with default and regions keys.
+type AccountRegions struct {
+	Default string   `yaml:"default" doc:"Region used when none is chosen" schema:"region"`
+	Regions []string `yaml:"regions" doc:"All regions of the account" schema:"regions"`
+}
+
+// UnmarshalYAML accepts both the single region and the default/regions forms
+func (a *AccountRegions) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		a.Default = node.Value
+		a.Regions = []string{node.Value}
+		return nil
+	}
+
+	type plain AccountRegions
+	var decoded plain
+	if err := node.Decode(&decoded); err != nil {
+		return err
+	}
+	*a = AccountRegions(decoded)
+
+	if a.Default == "" && len(a.Regions) > 0 {
+		a.Default = a.Regions[0]
+	}
+	if a.Default != "" && !contains(a.Regions, a.Default) {
+		a.Regions = append([]string{a.Default}, a.Regions...)
+	}
+	return nil
+}
+
+// MarshalYAML writes single region accounts back in their short form
+func (a AccountRegions) MarshalYAML() (interface{}, error) {
+	if len(a.Regions) <= 1 {
+		return a.Default, nil
+	}
+	type plain AccountRegions
+	return plain(a), nil
+}
+
+// RegionsForAccount returns the regions declared for an account in default_regions
+func (c *Config) RegionsForAccount(accountID string) (AccountRegions, error) {
+	regions, exists := c.DefaultRegions[accountID]
+	if !exists || regions.Default == "" {
+		return AccountRegions{}, fmt.Errorf("region not found for account ID: %s", accountID)
+	}
+	return regions, nil
+}
+
+// KnownRegions returns the built-in region catalog extended with the regions declared in invoke.yaml, sorted
+func (c *Config) KnownRegions() []string {
+	seen := map[string]bool{}
+	var regions []string
+	for _, region := range append(append([]string{}, awsRegions...), c.Regions.Extra...) {
+		if !seen[region] {
+			seen[region] = true
+			regions = append(regions, region)
+		}
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// AllowedRegions returns the regions the account may use. Accounts without a restriction may use any known region.
+func (c *Config) AllowedRegions(accountID string) []string {
+	if allowed, exists := c.Regions.Allowed[accountID]; exists && len(allowed) > 0 {
+		return allowed
+	}
+	return c.KnownRegions()
+}
+
+// CheckRegion verifies that a region is known and allowed for the account, naming the expected regions otherwise
+func (c *Config) CheckRegion(accountID, region string) error {
+	if !contains(c.KnownRegions(), region) {
+		return fmt.Errorf("%q is not a known region; expected one of: %s (extend the catalog with regions.extra in invoke.yaml)", region, strings.Join(c.KnownRegions(), ", "))
+	}
+	if allowed := c.AllowedRegions(accountID); !contains(allowed, region) {
+		return fmt.Errorf("region %q is not allowed for account %s; expected one of: %s", region, accountID, strings.Join(allowed, ", "))
+	}
+	return nil
+}
+
+// contains reports whether a slice contains the given value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Target is a fully resolved deployment target: where a stack lives and where its state is kept
+type Target struct {
+	Project     string
+	Environment string
+	AccountID   string
+	Region      string
+	Endpoint    string
+	Bucket      string
+	KeyPrefix   string
+	StateKey    string            // Empty unless the target was resolved from a stack path
+	Options     map[string]string // Additional backend settings
+	Backend     Backend
+	Credentials CredentialSettings // Resolved lazily through ResolveCredentials
+	Variables   map[string]Secret  // OpenTofu input variables, resolved lazily through VariableEnv
+
+	root string
+}
+
+// Resolver turns environment names and stack paths into deployment targets.
+// It is the only place where environments are mapped to accounts, regions and state locations.
+type Resolver struct {
+	cfg *Config
+}
+
+// NewResolver creates a resolver for the given configuration
+func NewResolver(cfg *Config) *Resolver {
+	return &Resolver{cfg: cfg}
+}
+
+// Resolve resolves a target from an environment name, a stack path, or both.
+// When a path is given the environment may be left empty and is taken from the path;
+// if both are given they must agree. The state key is only set when a path is given.
+func (r *Resolver) Resolve(environment, path string) (*Target, error) {
+	if path == "" {
+		if environment == "" {
+			return nil, fmt.Errorf("either an environment or a stack path is required")
+		}
+		return r.resolveEnvironment(environment, "")
+	}
+
+	layout, err := r.cfg.StackLayout()
+	if err != nil {
+		return nil, err
+	}
+
+	relPath, err := r.relativePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	location, err := layout.Parse(relPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if environment != "" && environment != location.Environment {
+		return nil, fmt.Errorf("conflict: environment %q was requested but path %s belongs to environment %q", environment, relPath, location.Environment)
+	}
+
+	env, err := r.cfg.Environment(location.Environment)
+	if err != nil {
+		return nil, err
+	}
+
+	if layout.Has(placeholderAccount) && location.Account != env.Account {
+		return nil, fmt.Errorf("conflict: path %s places environment %q under account %s, but the configuration maps it to account %s", relPath, location.Environment, location.Account, env.Account)
+	}
+	if layout.Has(placeholderRegion) {
+		if err := r.cfg.CheckRegion(env.Account, location.Region); err != nil {
+			return nil, fmt.Errorf("path %s: %w", relPath, err)
+		}
+	}
+
+	// Any region declared for the account is accepted; without a region in the layout the default is used
+	target, err := r.resolveEnvironment(location.Environment, location.Region)
+	if err != nil {
+		return nil, fmt.Errorf("conflict: path %s: %w", relPath, err)
+	}
+
+	target.StateKey = filepath.Join(target.KeyPrefix, relPath, "service.tfstate")
+
+	return target, nil
+}
+
+// ResolveRegion resolves the named environment in one of the regions declared for its account.
+// An empty region selects the account's default region.
+func (r *Resolver) ResolveRegion(environment, region string) (*Target, error) {
+	return r.resolveEnvironment(environment, region)
+}
+
+// Regions returns the regions declared for the account of the named environment
+func (r *Resolver) Regions(environment string) (AccountRegions, error) {
+	env, err := r.cfg.Environment(environment)
+	if err != nil {
+		return AccountRegions{}, err
+	}
+	return r.cfg.RegionsForAccount(env.Account)
+}
+
+// StackDir returns the absolute directory of a team's service within the target, as defined by the layout
+func (r *Resolver) StackDir(target *Target, teamName, serviceName string) (string, error) {
+	layout, err := r.cfg.StackLayout()
+	if err != nil {
+		return "", err
+	}
+
+	relPath, err := layout.Format(&Location{
+		Account:     target.AccountID,
+		Environment: target.Environment,
+		Region:      target.Region,
+		Team:        teamName,
+		Service:     serviceName,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(r.cfg.Root, relPath), nil
+}
+
+// TeamDir returns the absolute directory of a team within the target, the layout up to {team}
+func (r *Resolver) TeamDir(target *Target, teamName string) (string, error) {
+	layout, err := r.cfg.StackLayout()
+	if err != nil {
+		return "", err
+	}
+
+	relPath, err := layout.FormatPrefix(&Location{
+		Account:     target.AccountID,
+		Environment: target.Environment,
+		Region:      target.Region,
+		Team:        teamName,
+	}, placeholderTeam)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(r.cfg.Root, relPath), nil
+}
+
+// relativePath returns the given path relative to the repository root
+func (r *Resolver) relativePath(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return filepath.Clean(path), nil
+	}
+
+	relPath, err := filepath.Rel(r.cfg.Root, path)
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s is outside of the repository root %s", path, r.cfg.Root)
+	}
+	return relPath, nil
+}
+
+// resolveEnvironment resolves the account, region and state location of the named environment.
+// An empty region selects the account's default region.
+func (r *Resolver) resolveEnvironment(name, region string) (*Target, error) {
+	env, err := r.cfg.Environment(name)
+	if err != nil {
+		return nil, err
+	}
+
+	regions, err := r.cfg.RegionsForAccount(env.Account)
+	if err != nil {
+		return nil, fmt.Errorf("environment %q: %w", name, err)
+	}
+	if region == "" {
+		region = regions.Default
+	}
+	if !contains(regions.Regions, region) {
+		return nil, fmt.Errorf("region %s is not declared for account %s in default_regions; declared: %s", region, env.Account, strings.Join(regions.Regions, ", "))
+	}
+	if err := r.cfg.CheckRegion(env.Account, region); err != nil {
+		return nil, fmt.Errorf("account %s: %w", env.Account, err)
+	}
+
+	state := r.cfg.StateFor(name)
+	backend, err := NewBackend(state.Type, r.cfg.Root)
+	if err != nil {
+		return nil, fmt.Errorf("environment %q: %w", name, err)
+	}
+	if state.Endpoint == "" && (state.Type == BackendMinio || state.Type == BackendHTTP) {
+		return nil, fmt.Errorf("no state endpoint configured for environment %q", name)
+	}
+
+	return &Target{
+		Project:     r.cfg.Tofu.Project,
+		Environment: name,
+		AccountID:   env.Account,
+		Region:      region,
+		Endpoint:    state.Endpoint,
+		Bucket:      state.Bucket,
+		KeyPrefix:   state.KeyPrefix,
+		Options:     state.Options,
+		Backend:     backend,
+		Credentials: state.Credentials,
+		Variables:   r.cfg.VariablesFor(name),
+		root:        r.cfg.Root,
+	}, nil
+}
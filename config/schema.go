@@ -0,0 +1,312 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Patterns used by the schema. Account IDs are only required to be numeric: AWS issues 12 digit
+// IDs, but S3 compatible backends such as MinIO and older configurations use shorter ones.
+const (
+	accountPattern     = `^[0-9]+$`
+	environmentPattern = `^[a-z][a-z0-9-]*$`
+)
+
+// Schema is a JSON Schema (draft 2020-12) document or subschema. It is generated from the
+// Config type, so that editors and `wrapter config validate` check invoke.yaml the same way.
+type Schema struct {
+	SchemaURI            string             `json:"$schema,omitempty"`
+	ID                   string             `json:"$id,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Defs                 map[string]*Schema `json:"$defs,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Examples             []string           `json:"examples,omitempty"` // Offered by editors, not validated
+	Pattern              string             `json:"pattern,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"` // false or *Schema
+	PropertyNames        *Schema            `json:"propertyNames,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+}
+
+// GenerateSchema builds the JSON Schema of the configuration files from the Config type.
+// The regions known to cfg are offered as an enum and its environment names as examples, which
+// leaves the environment name pattern enforced; cfg may be nil.
+func GenerateSchema(cfg *Config) *Schema {
+	regions := awsRegions
+	var environments []string
+	if cfg != nil {
+		regions = cfg.KnownRegions()
+		environments = cfg.EnvironmentNames()
+	}
+
+	environmentName := &Schema{
+		Type:        "string",
+		Description: "Environment name",
+		Pattern:     environmentPattern,
+		Examples:    environments,
+	}
+
+	schema := schemaFor(reflect.TypeOf(Config{}), nil)
+	schema.SchemaURI = "https://json-schema.org/draft/2020-12/schema"
+	schema.ID = "https://github.com/jamalshahverdiev/wrapter/invoke.schema.json"
+	schema.Title = "wrapter invoke.yaml"
+	schema.Defs = map[string]*Schema{
+		"account":     {Type: "string", Description: "AWS account ID, digits only", Pattern: accountPattern},
+		"region":      {Type: "string", Description: "Region code from the built-in catalog or regions.extra", Enum: regions},
+		"environment": environmentName,
+	}
+	return schema
+}
+
+// schemaFor builds the schema of a Go type; options come from the schema struct tag
+func schemaFor(t reflect.Type, options []string) *Schema {
+	if t == reflect.TypeOf(AccountRegions{}) {
+		// Either a single region or the default/regions mapping, see AccountRegions.UnmarshalYAML
+		return &Schema{AnyOf: []*Schema{{Ref: "#/$defs/region"}, structSchema(t)}}
+	}
+
+	for _, option := range options {
+		switch {
+		case option == "region" || option == "account":
+			return &Schema{Ref: "#/$defs/" + option}
+		case strings.HasPrefix(option, "enum="):
+			return &Schema{Type: "string", Enum: strings.Split(strings.TrimPrefix(option, "enum="), "|")}
+		}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		return structSchema(t)
+
+	case reflect.Map:
+		schema := &Schema{Type: "object", AdditionalProperties: schemaFor(t.Elem(), valueOptions(options))}
+		for _, option := range options {
+			switch option {
+			case "accounts":
+				schema.PropertyNames = &Schema{Ref: "#/$defs/account"}
+			case "environments":
+				schema.PropertyNames = &Schema{Ref: "#/$defs/environment"}
+			}
+		}
+		return schema
+
+	case reflect.Slice:
+		return &Schema{Type: "array", Items: schemaFor(t.Elem(), itemOptions(options))}
+
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+
+	case reflect.Int, reflect.Int64:
+		return &Schema{Type: "integer"}
+
+	default:
+		schema := &Schema{Type: "string"}
+		for _, option := range options {
+			if strings.HasPrefix(option, "pattern=") {
+				schema.Pattern = strings.TrimPrefix(option, "pattern=")
+			}
+		}
+		return schema
+	}
+}
+
+// structSchema builds a closed object schema from the yaml tagged fields of a struct
+func structSchema(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: map[string]*Schema{}, AdditionalProperties: false}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if strings.Contains(field.Tag.Get("yaml"), ",inline") {
+			for key, property := range structSchema(field.Type).Properties {
+				schema.Properties[key] = property
+			}
+			continue
+		}
+
+		property := schemaFor(field.Type, schemaOptions(field.Tag.Get("schema")))
+		property.Description = field.Tag.Get("doc")
+		schema.Properties[name] = property
+	}
+	return schema
+}
+
+// schemaOptions splits a schema struct tag; a pattern option takes the rest of the tag
+func schemaOptions(tag string) []string {
+	if tag == "" {
+		return nil
+	}
+	if i := strings.Index(tag, "pattern="); i >= 0 {
+		return append(schemaOptions(strings.TrimSuffix(tag[:i], ",")), tag[i:])
+	}
+	return strings.Split(tag, ",")
+}
+
+// valueOptions returns the options applying to the values of a map, its keys are described
+// by the accounts and environments options
+func valueOptions(options []string) []string {
+	var result []string
+	for _, option := range options {
+		if option != "accounts" && option != "environments" {
+			result = append(result, option)
+		}
+	}
+	return result
+}
+
+// itemOptions returns the options applying to the items of a list
+func itemOptions(options []string) []string {
+	var result []string
+	for _, option := range options {
+		switch {
+		case option == "regions":
+			result = append(result, "region")
+		case strings.HasPrefix(option, "pattern="):
+			result = append(result, option)
+		}
+	}
+	return result
+}
+
+// validateLayer checks a configuration layer against the schema
+func (s *Schema) validateLayer(source *layer) []Problem {
+	return s.validate(s, source.node, "", source.originNear)
+}
+
+// validate checks a flattened YAML node against the schema, returning every problem found
+func (s *Schema) validate(root *Schema, node *yaml.Node, path string, origin func(string) string) []Problem {
+	if s.Ref != "" {
+		return root.Defs[strings.TrimPrefix(s.Ref, "#/$defs/")].validate(root, node, path, origin)
+	}
+
+	report := func(format string, args ...interface{}) []Problem {
+		return []Problem{{Path: path, Origin: origin(path), Message: fmt.Sprintf(format, args...)}}
+	}
+
+	// A null value decodes to the zero value of any type
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return nil
+	}
+
+	if s.Type != "" && !s.matchesType(node) {
+		return report("expected %s, found %s", s.Type, describeNode(node))
+	}
+
+	var problems []Problem
+	if len(s.AnyOf) > 0 {
+		var candidate []Problem
+		matched := false
+		for _, branch := range s.AnyOf {
+			branchProblems := branch.validate(root, node, path, origin)
+			if len(branchProblems) == 0 {
+				matched = true
+				break
+			}
+			if candidate == nil && branch.resolve(root).matchesType(node) {
+				candidate = branchProblems
+			}
+		}
+		if !matched {
+			if candidate == nil {
+				return report("unexpected %s", describeNode(node))
+			}
+			return candidate
+		}
+	}
+
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if len(s.Enum) > 0 && !contains(s.Enum, node.Value) {
+			if len(s.Enum) > 10 {
+				problems = append(problems, report("%q is not an allowed value", node.Value)...)
+			} else {
+				problems = append(problems, report("%q is not one of: %s", node.Value, strings.Join(s.Enum, ", "))...)
+			}
+		}
+		if s.Pattern != "" && !regexp.MustCompile(s.Pattern).MatchString(node.Value) {
+			problems = append(problems, report("%q does not match the pattern %s", node.Value, s.Pattern)...)
+		}
+
+	case yaml.SequenceNode:
+		if s.Items != nil {
+			for _, item := range node.Content {
+				problems = append(problems, s.Items.validate(root, item, path, origin)...)
+			}
+		}
+
+	case yaml.MappingNode:
+		for i := 0; i < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			childPath := joinPath(path, key.Value)
+			if s.PropertyNames != nil {
+				for _, problem := range s.PropertyNames.validate(root, key, childPath, origin) {
+					problem.Message = "invalid key: " + problem.Message
+					problems = append(problems, problem)
+				}
+			}
+			if property, exists := s.Properties[key.Value]; exists {
+				problems = append(problems, property.validate(root, value, childPath, origin)...)
+				continue
+			}
+			switch additional := s.AdditionalProperties.(type) {
+			case *Schema:
+				problems = append(problems, additional.validate(root, value, childPath, origin)...)
+			case bool:
+				if !additional {
+					problems = append(problems, Problem{Path: childPath, Origin: origin(childPath), Message: fmt.Sprintf("unknown field %q", key.Value)})
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+// resolve follows a $ref to the schema it points at
+func (s *Schema) resolve(root *Schema) *Schema {
+	if s.Ref != "" {
+		return root.Defs[strings.TrimPrefix(s.Ref, "#/$defs/")]
+	}
+	return s
+}
+
+// matchesType reports whether the node has the kind the schema type requires. Any scalar is
+// accepted for strings since YAML decodes numbers and booleans into string fields.
+func (s *Schema) matchesType(node *yaml.Node) bool {
+	switch s.Type {
+	case "object":
+		return node.Kind == yaml.MappingNode
+	case "array":
+		return node.Kind == yaml.SequenceNode
+	case "string":
+		return node.Kind == yaml.ScalarNode
+	case "integer":
+		return node.Kind == yaml.ScalarNode && node.Tag == "!!int"
+	case "boolean":
+		return node.Kind == yaml.ScalarNode && node.Tag == "!!bool"
+	default:
+		return true
+	}
+}
+
+// describeNode names the kind of a YAML node for error messages
+func describeNode(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.SequenceNode:
+		return "a list"
+	default:
+		return fmt.Sprintf("%q", node.Value)
+	}
+}
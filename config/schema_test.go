@@ -0,0 +1,105 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// validConfiguration passes validation, the tests below break one value at a time
+const validConfiguration = `version: 2
+tofu:
+  project: company
+common_service:
+  module_git_url: "git::https://example.com/modules.git"
+  module_version: "0.5.2"
+state:
+  endpoint: "http://minio:9000"
+default_regions:
+  "111111111111": us-east-1
+  "222222222": eu-central-1
+environments:
+  prod:
+    account: "111111111111"
+  dev:
+    account: "222222222"
+`
+
+// validate writes configuration as invoke.yaml and returns the problems Validate reports
+func validate(t *testing.T, configuration string) []string {
+	t.Helper()
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "invoke.yaml"), configuration)
+	problems, err := Validate(LoadOptions{Root: root, Dir: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, problem.String())
+	}
+	return messages
+}
+
+func TestValidateValid(t *testing.T) {
+	if problems := validate(t, validConfiguration); len(problems) > 0 {
+		t.Errorf("unexpected problems:\n%s", strings.Join(problems, "\n"))
+	}
+}
+
+func TestValidateProblems(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		old     string
+		new     string
+		problem string
+	}{
+		{
+			name:    "account key",
+			old:     `"222222222": eu-central-1`,
+			new:     `"dev-account": eu-central-1`,
+			problem: `invoke.yaml:11: default_regions.dev-account: invalid key: "dev-account" does not match the pattern ^[0-9]+$`,
+		},
+		{
+			name:    "account value",
+			old:     `account: "111111111111"`,
+			new:     `account: "prod"`,
+			problem: `invoke.yaml:14: environments.prod.account: "prod" does not match the pattern ^[0-9]+$`,
+		},
+		{
+			name:    "region",
+			old:     "us-east-1",
+			new:     "us-nowhere-1",
+			problem: `invoke.yaml:10: default_regions.111111111111: "us-nowhere-1"`,
+		},
+		{
+			name:    "environment name",
+			old:     "  prod:",
+			new:     "  Stable_X:",
+			problem: `environments.Stable_X: invalid key: "Stable_X" does not match the pattern ^[a-z][a-z0-9-]*$`,
+		},
+		{
+			name:    "unknown field",
+			old:     "  project: company",
+			new:     "  project: company\n  projet: company",
+			problem: `invoke.yaml:4: tofu.projet: unknown field "projet"`,
+		},
+		{
+			name:    "missing account",
+			old:     `    account: "222222222"`,
+			new:     `    account: "333333333"`,
+			problem: "environments.dev.account: account 333333333 is missing from default_regions",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			configuration := strings.Replace(validConfiguration, test.old, test.new, 1)
+			problems := validate(t, configuration)
+			for _, problem := range problems {
+				if strings.Contains(problem, test.problem) {
+					return
+				}
+			}
+			t.Errorf("no problem contains %q, got:\n%s", test.problem, strings.Join(problems, "\n"))
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Secret reference prefixes
+const (
+	SecretEnv  = "env:"  // env:NAME reads an environment variable
+	SecretFile = "file:" // file:path reads a file, relative paths are relative to the root
+	SecretCmd  = "cmd:"  // cmd:command runs a command through sh -c and reads its output
+)
+
+// maskedValue replaces secrets in output
+const maskedValue = "****"
+
+// Secret is a configuration value that may reference a secret instead of holding it, see the
+// Secret* prefixes. References are resolved lazily by Resolve, when a command needs the value;
+// resolved values are masked by Mask and never written back by the configuration output.
+type Secret string
+
+var (
+	secretsMu sync.Mutex
+	resolved  = map[string]string{} // Reference and root to value, commands and files are read once
+	known     []string              // Values to mask, longest first
+)
+
+// Reference returns the kind and argument of a secret reference, ok is false for plain values
+func (s Secret) Reference() (kind, argument string, ok bool) {
+	for _, prefix := range []string{SecretEnv, SecretFile, SecretCmd} {
+		if strings.HasPrefix(string(s), prefix) {
+			return prefix, strings.TrimPrefix(string(s), prefix), true
+		}
+	}
+	return "", "", false
+}
+
+// Resolve returns the value of the secret, reading the referenced variable, file or command
+// output. Relative files and commands are resolved in root. Only referenced values are
+// registered for masking, plain values such as regions would mask unrelated output.
+func (s Secret) Resolve(root string) (string, error) {
+	kind, argument, ok := s.Reference()
+	if !ok {
+		return string(s), nil
+	}
+
+	secretsMu.Lock()
+	value, cached := resolved[root+"\x00"+string(s)]
+	secretsMu.Unlock()
+	if cached {
+		return value, nil
+	}
+
+	switch kind {
+	case SecretEnv:
+		var set bool
+		if value, set = os.LookupEnv(argument); !set {
+			return "", fmt.Errorf("secret %s: environment variable %s is not set", s, argument)
+		}
+
+	case SecretFile:
+		path := argument
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(root, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %w", s, err)
+		}
+		value = strings.TrimRight(string(data), "\r\n")
+
+	case SecretCmd:
+		var stdout, stderr bytes.Buffer
+		command := exec.Command("sh", "-c", argument)
+		command.Dir = root
+		command.Stdout = &stdout
+		command.Stderr = &stderr
+		if err := command.Run(); err != nil {
+			return "", fmt.Errorf("secret %s: %w: %s", s, err, Mask(strings.TrimSpace(stderr.String())))
+		}
+		value = strings.TrimRight(stdout.String(), "\r\n")
+	}
+
+	secretsMu.Lock()
+	resolved[root+"\x00"+string(s)] = value
+	secretsMu.Unlock()
+	RegisterSecret(value)
+	return value, nil
+}
+
+// MarshalYAML keeps references, which name a secret without revealing it, and masks plain values
+func (s Secret) MarshalYAML() (interface{}, error) {
+	if _, _, ok := s.Reference(); ok || s == "" {
+		return string(s), nil
+	}
+	return maskedValue, nil
+}
+
+// RegisterSecret records a secret value so that Mask hides it
+func RegisterSecret(value string) {
+	// Very short values would mask unrelated text
+	if len(value) < 4 {
+		return
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, existing := range known {
+		if existing == value {
+			return
+		}
+	}
+	known = append(known, value)
+	// Longer secrets first, so a secret containing another one is masked as a whole
+	sort.Slice(known, func(i, j int) bool { return len(known[i]) > len(known[j]) })
+}
+
+// Mask replaces every registered secret value in text
+func Mask(text string) string {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, value := range known {
+		text = strings.ReplaceAll(text, value, maskedValue)
+	}
+	return text
+}
+
+// resolveSecrets resolves a map of secrets
+func resolveSecrets(secrets map[string]Secret, root string) (map[string]string, error) {
+	values := make(map[string]string, len(secrets))
+	for _, name := range sortedKeys(secrets) {
+		value, err := secrets[name].Resolve(root)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// VariablesFor returns the OpenTofu input variables of the named environment, the environment's
+// own variables overriding the global ones
+func (c *Config) VariablesFor(name string) map[string]Secret {
+	variables := map[string]Secret{}
+	for key, value := range c.Variables {
+		variables[key] = value
+	}
+	for key, value := range c.Environments[name].Variables {
+		variables[key] = value
+	}
+	return variables
+}
+
+// VariableEnv resolves the input variables of the target into TF_VAR_<name>=value entries
+// for the environment of tofu commands
+func (t *Target) VariableEnv() ([]string, error) {
+	values, err := resolveSecrets(t.Variables, t.root)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve variable %w", err)
+	}
+
+	return variableEnv(values), nil
+}
+
+// VariablePlaceholderEnv returns the entries of VariableEnv without resolving anything, for dry
+// runs: secret references are replaced with a placeholder naming them, e.g. <env:TOKEN>
+func (t *Target) VariablePlaceholderEnv() []string {
+	values := make(map[string]string, len(t.Variables))
+	for name, value := range t.Variables {
+		values[name] = string(value)
+		if _, _, ok := value.Reference(); ok {
+			values[name] = "<" + string(value) + ">"
+		}
+	}
+	return variableEnv(values)
+}
+
+// variableEnv returns TF_VAR_<name>=value entries sorted by name
+func variableEnv(values map[string]string) []string {
+	env := make([]string, 0, len(values))
+	for _, name := range sortedKeys(values) {
+		env = append(env, "TF_VAR_"+name+"="+values[name])
+	}
+	return env
+}
@@ -0,0 +1,29 @@
+package config
+
+import "testing"
+
+func TestResolveMasksOnlyReferences(t *testing.T) {
+	t.Setenv("WRAPTER_TEST_TOKEN", "s3cr3t-token")
+
+	variables := map[string]Secret{
+		"aws_region": "us-east-1",
+		"token":      "env:WRAPTER_TEST_TOKEN",
+	}
+	values, err := resolveSecrets(variables, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["aws_region"] != "us-east-1" || values["token"] != "s3cr3t-token" {
+		t.Fatalf("unexpected values %v", values)
+	}
+
+	if got, want := Mask("prod/us-east-1/payments token=s3cr3t-token"), "prod/us-east-1/payments token=****"; got != want {
+		t.Errorf("Mask() = %q, want %q", got, want)
+	}
+}
+
+func TestResolveUnsetEnv(t *testing.T) {
+	if _, err := Secret("env:WRAPTER_TEST_UNSET").Resolve(t.TempDir()); err == nil {
+		t.Error("expected an error for an unset environment variable")
+	}
+}
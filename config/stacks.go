@@ -0,0 +1,147 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Stack is a stack directory of the repository, laid out according to the layout
+type Stack struct {
+	ID  string // Layout path without the account, which the environment implies, e.g. prod/us-east-1/payments/ledger
+	Dir string // Absolute directory
+	Location
+}
+
+// StackID returns the ID of the stack at a location: its layout path without the account segment
+func (l *Layout) StackID(location *Location) string {
+	var parts []string
+	for _, segment := range l.segments {
+		name, isPlaceholder := placeholderName(segment)
+		switch {
+		case !isPlaceholder:
+			parts = append(parts, segment)
+		case name != placeholderAccount:
+			parts = append(parts, *location.field(name))
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// StackName names a directory in output: its stack ID when it is laid out according to the
+// layout, its path relative to the root otherwise
+func (r *Resolver) StackName(dir string) string {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return dir
+	}
+	relPath, err := r.relativePath(absDir)
+	if err != nil {
+		return dir
+	}
+	if layout, err := r.cfg.StackLayout(); err == nil {
+		if location, err := layout.Parse(relPath); err == nil {
+			return layout.StackID(location)
+		}
+	}
+	return filepath.ToSlash(relPath)
+}
+
+// glob returns a filepath.Glob pattern matching every stack directory under root
+func (l *Layout) glob(root string) string {
+	parts := []string{root}
+	for _, segment := range l.segments {
+		if _, isPlaceholder := placeholderName(segment); isPlaceholder {
+			parts = append(parts, "*")
+		} else {
+			parts = append(parts, segment)
+		}
+	}
+	return filepath.Join(parts...)
+}
+
+// FindStacks returns every directory of the repository matching the layout, sorted by ID.
+// Hidden directories are skipped.
+func (r *Resolver) FindStacks() ([]*Stack, error) {
+	layout, err := r.cfg.StackLayout()
+	if err != nil {
+		return nil, err
+	}
+
+	matches, err := filepath.Glob(layout.glob(r.cfg.Root))
+	if err != nil {
+		return nil, err
+	}
+
+	var stacks []*Stack
+	for _, dir := range matches {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		relPath, err := r.relativePath(dir)
+		if err != nil || hasHiddenSegment(relPath) {
+			continue
+		}
+		location, err := layout.Parse(relPath)
+		if err != nil {
+			continue
+		}
+		stacks = append(stacks, &Stack{ID: layout.StackID(location), Dir: dir, Location: *location})
+	}
+
+	sort.Slice(stacks, func(i, j int) bool { return stacks[i].ID < stacks[j].ID })
+	return stacks, nil
+}
+
+// SelectStacks returns the stacks matching any of the patterns, sorted by ID. A pattern is a
+// stack ID such as prod/us-east-1/payments/ledger, or a path relative to the root, either of
+// which may use path.Match globs, e.g. */*/payments/*. Every pattern must match a stack.
+func (r *Resolver) SelectStacks(patterns []string) ([]*Stack, error) {
+	stacks, err := r.FindStacks()
+	if err != nil {
+		return nil, err
+	}
+
+	selected := map[string]bool{}
+	for _, pattern := range patterns {
+		pattern = strings.Trim(filepath.ToSlash(pattern), "/")
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid stack pattern %q: %w", pattern, err)
+		}
+
+		matched := false
+		for _, stack := range stacks {
+			relPath, _ := r.relativePath(stack.Dir)
+			idMatch, _ := path.Match(pattern, stack.ID)
+			pathMatch, _ := path.Match(pattern, filepath.ToSlash(relPath))
+			if idMatch || pathMatch {
+				selected[stack.Dir] = true
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no stack matches %q", pattern)
+		}
+	}
+
+	var result []*Stack
+	for _, stack := range stacks {
+		if selected[stack.Dir] {
+			result = append(result, stack)
+		}
+	}
+	return result, nil
+}
+
+// hasHiddenSegment reports whether any segment of a relative path starts with a dot
+func hasHiddenSegment(relPath string) bool {
+	for _, segment := range strings.Split(filepath.ToSlash(relPath), "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"sort"
+)
+
+// StateSettings describes where the state of the stacks is stored. Set globally under state
+// and per environment under environments.<name>.state; empty per-environment values fall back
+// to the global ones.
+type StateSettings struct {
+	Type        string             `yaml:"type" doc:"Backend type, minio by default" schema:"enum=minio|s3|http|local"`
+	Endpoint    string             `yaml:"endpoint" doc:"Backend endpoint: S3 endpoint, state service base address or local state directory"`
+	Bucket      string             `yaml:"bucket" doc:"State bucket, <project>-tfstates by default"`
+	KeyPrefix   string             `yaml:"key_prefix" doc:"State key prefix, the project name by default"`
+	Options     map[string]string  `yaml:"options" doc:"Additional backend settings, passed through as -backend-config"`
+	Credentials CredentialSettings `yaml:"credentials" doc:"Where the backend credentials come from"`
+}
+
+// StateFor returns the effective state settings of the named environment
+func (c *Config) StateFor(name string) StateSettings {
+	state := StateSettings{
+		Type:        c.State.Type,
+		Endpoint:    c.State.Endpoint,
+		Bucket:      c.State.Bucket,
+		KeyPrefix:   c.State.KeyPrefix,
+		Options:     map[string]string{},
+		Credentials: c.State.Credentials,
+	}
+	for key, value := range c.State.Options {
+		state.Options[key] = value
+	}
+
+	if env, exists := c.Environments[name]; exists {
+		if env.State.Type != "" {
+			state.Type = env.State.Type
+		}
+		if env.State.Endpoint != "" {
+			state.Endpoint = env.State.Endpoint
+		}
+		if env.State.Bucket != "" {
+			state.Bucket = env.State.Bucket
+		}
+		if env.State.KeyPrefix != "" {
+			state.KeyPrefix = env.State.KeyPrefix
+		}
+		for key, value := range env.State.Options {
+			state.Options[key] = value
+		}
+		if env.State.Credentials.Source != "" {
+			state.Credentials = env.State.Credentials
+		}
+	}
+
+	if state.Type == "" {
+		state.Type = BackendMinio
+	}
+	if state.Bucket == "" {
+		state.Bucket = c.Tofu.Project + "-tfstates"
+	}
+	if state.KeyPrefix == "" {
+		state.KeyPrefix = c.Tofu.Project
+	}
+
+	return state
+}
+
+// OptionKeys returns the names of the additional backend settings in sorted order
+func (t *Target) OptionKeys() []string {
+	keys := make([]string, 0, len(t.Options))
+	for key := range t.Options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
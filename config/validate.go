@@ -0,0 +1,221 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Problem is a single configuration error, located where the offending value was defined
+type Problem struct {
+	Path    string // Dotted key path, empty for problems that aren't tied to a key
+	Origin  string // Where the value was defined, e.g. "invoke.yaml:12"
+	Message string
+}
+
+// String formats the problem as "origin: path: message"
+func (p Problem) String() string {
+	var sb strings.Builder
+	if p.Origin != "" {
+		sb.WriteString(p.Origin + ": ")
+	}
+	if p.Path != "" {
+		sb.WriteString(p.Path + ": ")
+	}
+	sb.WriteString(p.Message)
+	return sb.String()
+}
+
+// Validate loads every configuration layer and checks each one against the JSON Schema, so that
+// unknown and mistyped fields are reported where they were defined, then checks the merged
+// configuration semantically. It returns all problems found instead of stopping at the first one.
+func Validate(opts LoadOptions) ([]Problem, error) {
+	root, opts, err := prepareLoad(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	layers, err := readLayers(root, opts)
+	if err != nil {
+		return []Problem{{Message: err.Error()}}, nil
+	}
+
+	merged := newLayer()
+	for _, source := range layers {
+		mergeLayer(merged, source)
+	}
+
+	// The known regions come from the configuration itself, fall back to the built-in ones
+	var config Config
+	decodeErr := merged.node.Decode(&config)
+	schema := GenerateSchema(nil)
+	if decodeErr == nil {
+		schema = GenerateSchema(&config)
+	}
+
+	var problems []Problem
+	for _, source := range layers {
+		problems = append(problems, schema.validateLayer(source)...)
+	}
+	if decodeErr != nil {
+		// Type errors are normally reported per layer by the schema validation
+		if len(problems) == 0 {
+			problems = append(problems, Problem{Message: decodeErr.Error()})
+		}
+		return problems, nil
+	}
+	config.Root = root
+	config.Origins = merged.origins
+
+	return append(problems, config.Check()...), nil
+}
+
+// Check verifies the semantic consistency of the configuration and returns every problem found
+func (c *Config) Check() []Problem {
+	var problems []Problem
+	report := func(path, format string, args ...interface{}) {
+		problems = append(problems, Problem{Path: path, Origin: c.OriginNear(path), Message: fmt.Sprintf(format, args...)})
+	}
+
+	if err := checkWrapterVersion(c.MinWrapterVersion); err != nil {
+		report("min_wrapter_version", "%v", err)
+	}
+	if c.Tofu.Project == "" {
+		report("tofu.project", "project is required, it names the state bucket and key prefix")
+	}
+	if c.CommonService.ModuleGitURL == "" {
+		report("common_service.module_git_url", "module git URL is required to scaffold services")
+	}
+	if c.CommonService.ModuleVersion == "" {
+		report("common_service.module_version", "module version is required to scaffold services")
+	}
+	if _, err := c.StackLayout(); err != nil {
+		report("layout", "%v", err)
+	}
+	for _, err := range c.Discovery.check() {
+		report("discovery", "%v", err)
+	}
+
+	for _, account := range sortedKeys(c.DefaultRegions) {
+		regions := c.DefaultRegions[account]
+		path := "default_regions." + account
+		if regions.Default == "" {
+			report(path, "account declares no regions")
+		}
+		for _, region := range regions.Regions {
+			if err := c.CheckRegion(account, region); err != nil {
+				report(path, "%v", err)
+			}
+		}
+	}
+
+	for _, account := range sortedKeys(c.Regions.Allowed) {
+		for _, region := range c.Regions.Allowed[account] {
+			if !contains(c.KnownRegions(), region) {
+				report("regions.allowed."+account, "%q is not a known region", region)
+			}
+		}
+	}
+
+	if len(c.Environments) == 0 {
+		report("environments", "at least one environment is required")
+	}
+	for _, name := range c.EnvironmentNames() {
+		env := c.Environments[name]
+		path := "environments." + name
+		if env.Account == "" {
+			report(path+".account", "environment has no account")
+		} else if _, exists := c.DefaultRegions[env.Account]; !exists {
+			report(path+".account", "account %s is missing from default_regions", env.Account)
+		}
+		problems = append(problems, c.checkState(name)...)
+	}
+
+	// Problems with global settings are found once per environment, report them once
+	seen := map[string]bool{}
+	unique := problems[:0]
+	for _, problem := range problems {
+		key := problem.String()
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, problem)
+		}
+	}
+	return unique
+}
+
+// checkState verifies the effective state settings of an environment
+func (c *Config) checkState(name string) []Problem {
+	var problems []Problem
+	report := func(key, format string, args ...interface{}) {
+		// Point at the environment override when there is one, at the global setting otherwise
+		path := "environments." + name + ".state." + key
+		if c.Origin(path) == "" {
+			path = "state." + key
+		}
+		problems = append(problems, Problem{Path: path, Origin: c.OriginNear(path), Message: fmt.Sprintf(format, args...)})
+	}
+
+	state := c.StateFor(name)
+	if _, err := NewBackend(state.Type, c.Root); err != nil {
+		report("type", "%v", err)
+	}
+	if state.Endpoint == "" && (state.Type == BackendMinio || state.Type == BackendHTTP) {
+		report("endpoint", "endpoint is required for the %s backend", state.Type)
+	}
+
+	credentials := state.Credentials
+	switch credentials.Source {
+	case "", CredentialsEnv:
+	case CredentialsFile:
+		if credentials.File == "" {
+			report("credentials.file", "file is required for the file credentials source")
+		}
+	case CredentialsProfile:
+		if credentials.Profile == "" {
+			report("credentials.profile", "profile is required for the profile credentials source")
+		}
+	case CredentialsProcess:
+		if credentials.Command == "" {
+			report("credentials.command", "command is required for the process credentials source")
+		}
+	default:
+		report("credentials.source", "unsupported credentials source %q", credentials.Source)
+	}
+
+	return problems
+}
+
+// OriginNear returns the origin of a key path, or of the first value defined below it,
+// or of its closest defined parent, so that missing values still point somewhere useful
+func (c *Config) OriginNear(path string) string {
+	if origin := c.Origin(path); origin != "" {
+		return origin
+	}
+
+	var below []string
+	for originPath := range c.Origins {
+		if strings.HasPrefix(originPath, path+".") {
+			below = append(below, originPath)
+		}
+	}
+	if len(below) > 0 {
+		sort.Strings(below)
+		return c.Origin(below[0])
+	}
+
+	if i := strings.LastIndex(path, "."); i > 0 {
+		return c.OriginNear(path[:i])
+	}
+	return ""
+}
+
+// sortedKeys returns the keys of a string keyed map in sorted order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,362 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"wrapter/common"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CurrentVersion is the configuration format version this binary reads and `config migrate` writes.
+// Files without a version key are treated as version 1 when they hold keys of that format, and
+// as the current version otherwise: fragments and local files often have no version key.
+const CurrentVersion = 2
+
+// migration upgrades a configuration document from one format version to the next. It works on
+// the YAML node tree so that rewritten files keep their comments and anchors.
+type migration struct {
+	description string
+	apply       func(root *yaml.Node)
+}
+
+// migrations holds the upgrade from version i+1 to version i+2 at index i
+var migrations = []migration{
+	{description: "profiles.<name>, or else environments.<name>.aws, becomes environments.<name>.account, environments.endpoint moves to state.endpoint", apply: migrateV1},
+}
+
+// Migrate upgrades a parsed configuration document in place to CurrentVersion and returns the
+// version it had. Documents newer than CurrentVersion are refused.
+func Migrate(document *yaml.Node) (int, error) {
+	root := document
+	if root.Kind == yaml.DocumentNode {
+		if len(root.Content) == 0 {
+			return CurrentVersion, nil
+		}
+		root = root.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		return 0, fmt.Errorf("top level must be a mapping")
+	}
+
+	version, err := documentVersion(root)
+	if err != nil {
+		return 0, err
+	}
+	if version > CurrentVersion {
+		return 0, fmt.Errorf("configuration version %d is newer than the supported version %d, upgrade wrapter", version, CurrentVersion)
+	}
+
+	for v := version; v < CurrentVersion; v++ {
+		migrations[v-1].apply(root)
+	}
+	if version < CurrentVersion {
+		setVersion(root, CurrentVersion)
+	}
+	return version, nil
+}
+
+// MigrateFile upgrades a configuration file to CurrentVersion and returns its new content together
+// with the version it had. The file itself is not modified.
+func MigrateFile(path string) ([]byte, int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", path, err)
+	}
+	from, err := Migrate(&document)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", path, err)
+	}
+	if from == CurrentVersion {
+		return data, from, nil
+	}
+
+	// Decoded merge keys carry an explicit tag the encoder would otherwise write out as "!!merge <<"
+	clearMergeTags(&document)
+
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", path, err)
+	}
+	return buffer.Bytes(), from, nil
+}
+
+// clearMergeTags drops the tags of merge keys so they are written as plain "<<"
+func clearMergeTags(node *yaml.Node) {
+	for _, child := range node.Content {
+		if isMergeKey(child) {
+			child.Tag = ""
+		}
+		clearMergeTags(child)
+	}
+}
+
+// MigrationSteps describes the migrations applied when upgrading from the given version
+func MigrationSteps(from int) []string {
+	var steps []string
+	for v := from; v < CurrentVersion; v++ {
+		steps = append(steps, fmt.Sprintf("%d -> %d: %s", v, v+1, migrations[v-1].description))
+	}
+	return steps
+}
+
+// documentVersion returns the version key of a configuration mapping. When it is missing the
+// version is 1 if the mapping holds keys of that format, CurrentVersion otherwise.
+func documentVersion(root *yaml.Node) (int, error) {
+	node := lookupKey(root, "version")
+	if node == nil {
+		if hasV1Keys(root) {
+			return 1, nil
+		}
+		return CurrentVersion, nil
+	}
+	node = resolveAlias(node)
+	version, err := strconv.Atoi(node.Value)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("line %d: invalid configuration version %q", node.Line, node.Value)
+	}
+	return version, nil
+}
+
+// setVersion sets the version key of a configuration mapping, adding it as the first key
+func setVersion(root *yaml.Node, version int) {
+	value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(version)}
+	if lookupKey(root, "version") != nil {
+		setKey(root, "version", value)
+		return
+	}
+	key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "version"}
+	root.Content = append([]*yaml.Node{key, value}, root.Content...)
+}
+
+// hasV1Keys reports whether a configuration mapping holds keys that only exist in version 1:
+// profiles, environments.endpoint or environments.<name>.aws
+func hasV1Keys(root *yaml.Node) bool {
+	if lookupKey(root, "profiles") != nil {
+		return true
+	}
+	environments := lookupKey(root, "environments")
+	if environments == nil || resolveAlias(environments).Kind != yaml.MappingNode {
+		return false
+	}
+	environments = resolveAlias(environments)
+	if endpoint := lookupKey(environments, "endpoint"); endpoint != nil && resolveAlias(endpoint).Kind != yaml.MappingNode {
+		return true
+	}
+	for i := 1; i < len(environments.Content); i += 2 {
+		if env := resolveAlias(environments.Content[i]); env.Kind == yaml.MappingNode && lookupKey(env, "aws") != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// migrateV1 upgrades the original format: the account of each environment was listed under
+// profiles.<name>, often referenced from environments.<name>.aws as well, and
+// environments.endpoint held the MinIO endpoint
+func migrateV1(root *yaml.Node) {
+	profiles := lookupKey(root, "profiles")
+	defer func() {
+		// Aliases to profiles would dangle once the profiles are removed, inline their values
+		if profiles != nil {
+			inlineAliases(root, profiles)
+			deleteKey(root, "profiles")
+		}
+	}()
+
+	environments := lookupKey(root, "environments")
+	if environments == nil && profiles != nil {
+		environments = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		setKey(root, "environments", environments)
+	}
+	if environments == nil || environments.Kind != yaml.MappingNode {
+		return
+	}
+
+	if endpoint := lookupKey(environments, "endpoint"); endpoint != nil && endpoint.Kind != yaml.MappingNode {
+		endpointKey := mappingKey(environments, "endpoint")
+		deleteKey(environments, "endpoint")
+		state := lookupKey(root, "state")
+		if state == nil {
+			state = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			setKey(root, "state", state)
+		}
+		if state.Kind == yaml.MappingNode && lookupKey(state, "endpoint") == nil {
+			// The key node carries the comments written above and next to the key
+			setKeyNode(state, endpointKey, endpoint)
+		}
+	}
+
+	for i := 1; i < len(environments.Content); i += 2 {
+		env := resolveAlias(environments.Content[i])
+		if env.Kind != yaml.MappingNode {
+			continue
+		}
+		for j := 0; j < len(env.Content); j += 2 {
+			if env.Content[j].Value != "aws" {
+				continue
+			}
+			if lookupKey(env, "account") != nil {
+				env.Content = append(env.Content[:j], env.Content[j+2:]...)
+			} else {
+				env.Content[j].Value = "account"
+			}
+			break
+		}
+	}
+
+	if profiles != nil && resolveAlias(profiles).Kind == yaml.MappingNode {
+		setProfileAccounts(environments, resolveAlias(profiles))
+	}
+}
+
+// setProfileAccounts sets the account of each environment from profiles.<name>, which the
+// original format read the account from, adding the environments missing from environments
+func setProfileAccounts(environments, profiles *yaml.Node) {
+	for i := 0; i+1 < len(profiles.Content); i += 2 {
+		name, profile := profiles.Content[i].Value, resolveAlias(profiles.Content[i+1])
+		if profile.Kind != yaml.ScalarNode {
+			continue
+		}
+
+		env := lookupKey(environments, name)
+		switch {
+		case env == nil:
+			env = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			setKey(environments, name, env)
+		case env.Kind == yaml.AliasNode:
+			// The aliased environment may have another account, merge it instead
+			merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+				{Kind: yaml.ScalarNode, Tag: "!!merge", Value: "<<"}, env,
+			}}
+			setKey(environments, name, merged)
+			env = merged
+		case env.Kind != yaml.MappingNode:
+			continue
+		}
+
+		account := copyNode(profile)
+		account.Anchor = ""
+		if previous := lookupKey(env, "account"); previous != nil && previous.LineComment != "" {
+			account.LineComment = previous.LineComment
+		}
+		setKey(env, "account", account)
+	}
+}
+
+// inlineAliases replaces the aliases to nodes below target with copies of the nodes they refer to
+func inlineAliases(node, target *yaml.Node) {
+	for i, child := range node.Content {
+		if child.Kind == yaml.AliasNode && isDescendant(child.Alias, target) {
+			inlined := copyNode(child.Alias)
+			inlined.Anchor = ""
+			if child.LineComment != "" {
+				inlined.LineComment = child.LineComment
+			}
+			node.Content[i] = inlined
+			continue
+		}
+		if child != target {
+			inlineAliases(child, target)
+		}
+	}
+}
+
+// isDescendant reports whether node is target or one of the nodes below it
+func isDescendant(node, target *yaml.Node) bool {
+	if node == target {
+		return true
+	}
+	for _, child := range target.Content {
+		if isDescendant(node, child) {
+			return true
+		}
+	}
+	return false
+}
+
+// mappingKey returns the key node of a key in a mapping node, or nil
+func mappingKey(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i]
+		}
+	}
+	return nil
+}
+
+// deleteKey removes a key and its value from a mapping node
+func deleteKey(mapping *yaml.Node, key string) {
+	for i := 0; i < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// checkWrapterVersion refuses configurations that require a newer wrapter than this binary.
+// Development builds are not checked.
+func checkWrapterVersion(required string) error {
+	if required == "" || common.Version == "dev" {
+		return nil
+	}
+	older, err := versionLess(common.Version, required)
+	if err != nil {
+		return err
+	}
+	if older {
+		return fmt.Errorf("the configuration requires wrapter %s or newer, this is wrapter %s; please upgrade", required, common.Version)
+	}
+	return nil
+}
+
+// versionLess reports whether version a is lower than version b. Versions are dotted numbers
+// with an optional "v" prefix; pre-release and build suffixes are ignored.
+func versionLess(a, b string) (bool, error) {
+	aParts, err := parseVersion(a)
+	if err != nil {
+		return false, err
+	}
+	bParts, err := parseVersion(b)
+	if err != nil {
+		return false, err
+	}
+	for i := range aParts {
+		if aParts[i] != bParts[i] {
+			return aParts[i] < bParts[i], nil
+		}
+	}
+	return false, nil
+}
+
+// parseVersion parses a major.minor.patch version, missing parts being zero
+func parseVersion(version string) ([3]int, error) {
+	var parts [3]int
+	trimmed := strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(trimmed, "-+"); i >= 0 {
+		trimmed = trimmed[:i]
+	}
+	fields := strings.Split(trimmed, ".")
+	if len(fields) > 3 {
+		return parts, fmt.Errorf("invalid version %q", version)
+	}
+	for i, field := range fields {
+		number, err := strconv.Atoi(field)
+		if err != nil || number < 0 {
+			return parts, fmt.Errorf("invalid version %q", version)
+		}
+		parts[i] = number
+	}
+	return parts, nil
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the tests")
+
+func TestMigrateFileGolden(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		from int
+	}{
+		{"v1", 1},
+		{"profiles", 1},
+		{"v2", CurrentVersion},
+		{"fragment", CurrentVersion},
+	} {
+		input := filepath.Join("testdata", "migrate", test.name+".yaml")
+		golden := filepath.Join("testdata", "migrate", test.name+".golden")
+
+		data, from, err := MigrateFile(input)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if from != test.from {
+			t.Errorf("%s: migrated from version %d, want %d", test.name, from, test.from)
+		}
+
+		if *update {
+			if err := os.WriteFile(golden, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Errorf("%s: migrated content differs from %s:\n%s", test.name, golden, data)
+		}
+
+		// Files already in the current format are returned as they are
+		if test.from == CurrentVersion {
+			original, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, original) {
+				t.Errorf("%s: a file in the current format was rewritten", test.name)
+			}
+		}
+	}
+}
+
+func TestMigrateFileIdempotent(t *testing.T) {
+	migrated, _, err := MigrateFile(filepath.Join("testdata", "migrate", "v1.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "invoke.yaml")
+	if err := os.WriteFile(path, migrated, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	again, from, err := MigrateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != CurrentVersion || !bytes.Equal(again, migrated) {
+		t.Errorf("migrating a migrated file again changed it (from version %d):\n%s", from, again)
+	}
+}
+
+func TestMigrateKeepsComments(t *testing.T) {
+	migrated, _, err := MigrateFile(filepath.Join("testdata", "migrate", "v1.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, comment := range []string{"# Repository settings", "# primary account", "# dev cluster", "# production", "# MinIO endpoint shared by every environment"} {
+		if !strings.Contains(string(migrated), comment) {
+			t.Errorf("comment %q was lost:\n%s", comment, migrated)
+		}
+	}
+	for _, removed := range []string{"profiles:", "aws:", "*dev\n", "*prod"} {
+		if strings.Contains(string(migrated), removed) {
+			t.Errorf("%q is still in the migrated file:\n%s", removed, migrated)
+		}
+	}
+}
+
+func TestMigratedConfigurationLoads(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		accounts map[string]string
+	}{
+		{"v1", map[string]string{"dev": "222222222222", "stable": "222222222222", "prod": "111111111111"}},
+		{"profiles", map[string]string{"dev": "222222222222", "stable": "333333333333", "prod": "111111111111", "mgmt": "333333333333"}},
+	} {
+		root := t.TempDir()
+		migrated, _, err := MigrateFile(filepath.Join("testdata", "migrate", test.name+".yaml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, "invoke.yaml"), migrated, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := Load(LoadOptions{Root: root, Dir: root})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		for env, account := range test.accounts {
+			if got := cfg.Environments[env].Account; got != account {
+				t.Errorf("%s: environment %s: account %q, want %q", test.name, env, got, account)
+			}
+		}
+		if cfg.State.Endpoint != "http://10.100.100.100:9000" {
+			t.Errorf("%s: state endpoint %q", test.name, cfg.State.Endpoint)
+		}
+	}
+}
@@ -7,6 +7,9 @@ import (
 )
 
 func main() {
+	// Secrets resolved from the configuration never show up in log messages
+	utils.MaskLogOutput()
+
 	// Verify that all required binaries are available
 	if err := utils.VerifyRequirements(); err != nil {
 		log.Fatalf("Verification failed: %v", err)
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"wrapter/config"
+)
+
+// dryRunCredentialsFile stands for the credentials file on dry runs
+const dryRunCredentialsFile = "<credentials file>"
+
+// resolveCredentials returns the backend credentials of the target, placeholders on dry runs so
+// that no credential helper runs
+func resolveCredentials(target *config.Target) (*config.Credentials, error) {
+	if DryRun {
+		return target.PlaceholderCredentials(), nil
+	}
+	creds, err := target.ResolveCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve backend credentials: %w", err)
+	}
+	return creds, nil
+}
+
+// writeCredentialsFile writes the backend credentials of the target to a temporary backend
+// configuration file readable only by the current user, so that secrets never show up on a
+// command line. The returned function removes the file and must always be called. Dry runs
+// don't write the file and return a placeholder name.
+func writeCredentialsFile(target *config.Target, creds *config.Credentials) (string, func(), error) {
+	noop := func() {}
+
+	settings := target.Backend.CredentialConfig(creds)
+	if len(settings) == 0 {
+		return "", noop, nil
+	}
+	if DryRun {
+		return dryRunCredentialsFile, noop, nil
+	}
+
+	// os.CreateTemp creates the file with 0600 permissions
+	file, err := os.CreateTemp("", "wrapter-*.tfbackend")
+	if err != nil {
+		return "", noop, err
+	}
+	cleanup := func() { os.Remove(file.Name()) }
+	defer file.Close()
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if _, err := fmt.Fprintf(file, "%s = %s\n", key, hclString(settings[key])); err != nil {
+			cleanup()
+			return "", noop, err
+		}
+	}
+
+	return file.Name(), cleanup, nil
+}
+
+// hclString renders a value as an HCL string literal with template sequences escaped
+func hclString(value string) string {
+	quoted := strconv.Quote(value)
+	quoted = strings.ReplaceAll(quoted, "${", "$${")
+	return strings.ReplaceAll(quoted, "%{", "%%{")
+}
@@ -0,0 +1,316 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"wrapter/config"
+)
+
+// DefaultBase is the git revision --changed compares with by default
+const DefaultBase = "origin/main"
+
+var (
+	moduleBlockPattern  = regexp.MustCompile(`module\s+"[^"]+"\s*\{`)
+	localSourcePattern  = regexp.MustCompile(`\bsource\s*=\s*"(\.\.?/[^"]*)"`)
+	unscopedConfigPaths = []string{"common_service", "discovery", "min_wrapter_version", "regions.extra"}
+)
+
+// ChangedStacks returns the IDs of the stacks affected by the changes since the merge base of
+// base and HEAD, uncommitted and untracked files included. A stack is affected when a file of
+// its directory changed, a file of a local module it uses, directly or through other local
+// modules, or the configuration applying to it.
+func ChangedStacks(cfg *config.Config, base string) (map[string]bool, error) {
+	gitRoot, err := git(cfg.Root, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	mergeBase, err := git(gitRoot, "merge-base", base, "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("could not find the merge base of %s and HEAD: %w", base, err)
+	}
+
+	// Git reports paths relative to its root, which may be above the repository root and is
+	// free of symbolic links
+	realRoot, err := filepath.EvalSymlinks(cfg.Root)
+	if err != nil {
+		return nil, err
+	}
+	rootPrefix, err := filepath.Rel(gitRoot, realRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	changedNames, deletedNames, err := changedFiles(gitRoot, mergeBase)
+	if err != nil {
+		return nil, err
+	}
+	repositoryPaths := func(names []string) []string {
+		var paths []string
+		for _, name := range names {
+			relPath, err := filepath.Rel(rootPrefix, filepath.FromSlash(name))
+			if err != nil || strings.HasPrefix(relPath, "..") {
+				continue // Outside the repository root
+			}
+			paths = append(paths, filepath.Join(cfg.Root, relPath))
+		}
+		return paths
+	}
+	files, deleted := repositoryPaths(changedNames), repositoryPaths(deletedNames)
+
+	inventory, err := Inventory(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := map[string]bool{}
+	for _, info := range inventory {
+		modules, err := localModules(info.Dir, map[string]bool{})
+		if err != nil {
+			return nil, err
+		}
+		dirs := append([]string{info.Dir}, modules...)
+		for _, file := range files {
+			if isBelow(file, dirs...) {
+				changed[info.ID] = true
+				break
+			}
+		}
+	}
+
+	configFiles := map[string]bool{}
+	for _, name := range cfg.Files() {
+		configFiles[filepath.Join(cfg.Root, name)] = true
+	}
+	// Deleted files are no longer part of the configuration, but were at the merge base
+	for _, file := range deletedConfigFiles(cfg, gitRoot, mergeBase, rootPrefix, configFiles, deleted) {
+		configFiles[file] = true
+	}
+	for _, file := range files {
+		// Directory configuration files apply to the stacks below them, wherever they are
+		scope := cfg.Root
+		if filepath.Base(file) == config.DirConfigFile {
+			scope = filepath.Dir(file)
+		} else if !configFiles[file] {
+			continue
+		}
+
+		relPath, err := filepath.Rel(cfg.Root, file)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := changedConfigKeys(gitRoot, mergeBase, filepath.Join(rootPrefix, relPath), file)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range inventory {
+			if isBelow(info.Dir, scope) && configAffects(keys, info) {
+				changed[info.ID] = true
+			}
+		}
+	}
+	return changed, nil
+}
+
+// changedFiles returns the files changed since a revision, uncommitted and untracked ones
+// included, and separately those among them that were deleted or renamed away. Paths are
+// relative to the git root.
+func changedFiles(gitRoot, revision string) ([]string, []string, error) {
+	var changed, deleted []string
+	output, err := git(gitRoot, "diff", "--name-status", "-z", revision)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Each entry is a status followed by a path, or by the old and new paths of a rename or copy
+	fields := strings.Split(output, "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		status, name := fields[i], fields[i+1]
+		switch {
+		case strings.HasPrefix(status, "R") && i+2 < len(fields):
+			deleted = append(deleted, name)
+			changed = append(changed, name, fields[i+2])
+			i++
+		case strings.HasPrefix(status, "C") && i+2 < len(fields):
+			changed = append(changed, fields[i+2])
+			i++
+		case status == "D":
+			deleted = append(deleted, name)
+			changed = append(changed, name)
+		default:
+			changed = append(changed, name)
+		}
+	}
+
+	output, err = git(gitRoot, "ls-files", "--others", "--exclude-standard", "-z")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range strings.Split(output, "\x00") {
+		if name != "" {
+			changed = append(changed, name)
+		}
+	}
+	return changed, deleted, nil
+}
+
+// deletedConfigFiles returns the deleted files that were configuration files at the revision:
+// the local configuration file, and the fragments included by configuration files, deleted
+// or not, as they were at the revision
+func deletedConfigFiles(cfg *config.Config, gitRoot, revision, rootPrefix string, configFiles map[string]bool, deleted []string) []string {
+	var found []string
+	var including []string
+	for file := range configFiles {
+		including = append(including, file)
+	}
+	for _, file := range deleted {
+		if file == cfg.LocalFile() {
+			found = append(found, file)
+			including = append(including, file)
+		}
+	}
+
+	seen := map[string]bool{}
+	for len(including) > 0 {
+		file := including[0]
+		including = including[1:]
+		if seen[file] {
+			continue
+		}
+		seen[file] = true
+
+		relPath, err := filepath.Rel(cfg.Root, file)
+		if err != nil {
+			continue
+		}
+		before, err := git(gitRoot, "show", revision+":"+filepath.ToSlash(filepath.Join(rootPrefix, relPath)))
+		if err != nil {
+			continue // The file is new
+		}
+		patterns, err := config.IncludePatterns([]byte(before), filepath.Dir(file))
+		if err != nil {
+			continue // Nothing can be told about an invalid previous version
+		}
+		for _, pattern := range patterns {
+			for _, candidate := range deleted {
+				if matched, _ := filepath.Match(pattern, candidate); matched && !contains(found, candidate) {
+					found = append(found, candidate)
+					including = append(including, candidate)
+				}
+			}
+		}
+	}
+	return found
+}
+
+// changedConfigKeys returns the key paths of a configuration file that changed since a revision,
+// name being the path of the file relative to the git root
+func changedConfigKeys(gitRoot, revision, name, file string) ([]string, error) {
+	// A file missing in either version has no content there
+	before, _ := git(gitRoot, "show", revision+":"+filepath.ToSlash(name))
+	after, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	keys, err := config.ChangedKeys([]byte(before), after)
+	if err != nil {
+		return nil, fmt.Errorf("could not compare %s with %s: %w", name, revision, err)
+	}
+	return keys, nil
+}
+
+// configAffects reports whether a stack depends on any of the changed configuration keys:
+// environments.<name> applies to the stacks of that environment, default_regions.<account>
+// and regions.allowed.<account> to the stacks of that account, and the other sections to every
+// stack except for those that only matter to scaffolding and discovery
+func configAffects(keys []string, info *StackInfo) bool {
+	for _, key := range keys {
+		parts := strings.Split(key, ".")
+		switch {
+		case isUnscoped(key):
+			continue
+		case parts[0] == "environments" && len(parts) > 1:
+			if parts[1] == info.Environment {
+				return true
+			}
+		case parts[0] == "default_regions" && len(parts) > 1:
+			if parts[1] == info.Account {
+				return true
+			}
+		case parts[0] == "regions" && len(parts) > 2 && parts[1] == "allowed":
+			if parts[2] == info.Account {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// isUnscoped reports whether a configuration key path doesn't affect any stack
+func isUnscoped(key string) bool {
+	for _, prefix := range unscopedConfigPaths {
+		if key == prefix || strings.HasPrefix(key, prefix+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// localModules returns the directories of the local modules used by the Terraform code of a
+// directory, following the modules they use in turn
+func localModules(dir string, visited map[string]bool) ([]string, error) {
+	code, err := readTerraformFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var modules []string
+	for _, match := range moduleBlockPattern.FindAllStringIndex(code, -1) {
+		source := localSourcePattern.FindStringSubmatch(blockBody(code[match[1]:]))
+		if source == nil {
+			continue
+		}
+		module := filepath.Join(dir, filepath.FromSlash(source[1]))
+		if visited[module] {
+			continue
+		}
+		visited[module] = true
+		modules = append(modules, module)
+
+		nested, err := localModules(module, visited)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		modules = append(modules, nested...)
+	}
+	return modules, nil
+}
+
+// isBelow reports whether path is one of the directories or below one of them
+func isBelow(path string, dirs ...string) bool {
+	for _, dir := range dirs {
+		if path == dir || strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// git runs a git command in dir and returns its trimmed output
+func git(dir string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	command := exec.Command("git", args...)
+	command.Dir = dir
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+	if err := command.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"wrapter/config"
+)
+
+const (
+	prodLedger = "111111111111/prod/us-east-1/pay/ledger"
+	devLedger  = "222222222222/dev/us-east-1/pay/ledger"
+)
+
+// changesRepository commits a repository with a fragment per environment, a local
+// configuration file and a directory configuration file, and returns its root
+func changesRepository(t *testing.T) string {
+	t.Helper()
+	cfg := testRepository(t, testConfig+"include: [envs/*.yaml]\n", prodLedger, devLedger)
+	root := cfg.Root
+	for name, content := range map[string]string{
+		"envs/dev.yaml":                            "default_regions:\n  \"222222222222\": us-east-1\nenvironments:\n  dev:\n    account: \"222222222222\"\n",
+		config.LocalConfigFile:                     "tofu:\n  version: 1.8\n",
+		"222222222222/dev/" + config.DirConfigFile: "state:\n  bucket: dev-states\n",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "-A"},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "base"},
+	} {
+		if _, err := git(root, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// changedStacks loads the configuration of root and returns the sorted IDs of the stacks
+// affected by the changes since HEAD
+func changedStacks(t *testing.T, root string) []string {
+	t.Helper()
+	cfg, err := config.Load(config.LoadOptions{Root: root, Dir: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := ChangedStacks(cfg, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for id := range changed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestChangedStacksDeletedFiles(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		deleted string
+		want    []string
+	}{
+		{"nothing", "", []string{}},
+		{"fragment", "envs/dev.yaml", []string{"dev/us-east-1/pay/ledger"}},
+		{"directory configuration", "222222222222/dev/" + config.DirConfigFile, []string{"dev/us-east-1/pay/ledger"}},
+		{"local configuration", config.LocalConfigFile, []string{"dev/us-east-1/pay/ledger", "prod/us-east-1/pay/ledger"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			root := changesRepository(t)
+			if test.deleted != "" {
+				if err := os.Remove(filepath.Join(root, filepath.FromSlash(test.deleted))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if changed := changedStacks(t, root); !reflect.DeepEqual(changed, test.want) {
+				t.Errorf("changed stacks %v, want %v", changed, test.want)
+			}
+		})
+	}
+}
+
+func TestChangedStacksRenamedFile(t *testing.T) {
+	root := changesRepository(t)
+	extra := filepath.Join(root, filepath.FromSlash(prodLedger), "outputs.tf")
+	if err := os.WriteFile(extra, []byte("output \"name\" {\n  value = \"ledger\"\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git(root, "add", "-A"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git(root, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "outputs"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Moving the file away from the stack changes it
+	if _, err := git(root, "mv", extra, filepath.Join(root, "outputs.tf")); err != nil {
+		t.Fatal(err)
+	}
+	if want, changed := []string{"prod/us-east-1/pay/ledger"}, changedStacks(t, root); !reflect.DeepEqual(changed, want) {
+		t.Errorf("changed stacks %v, want %v", changed, want)
+	}
+}
@@ -0,0 +1,349 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"wrapter/config"
+)
+
+// DefaultLogDir is where batch commands write the log files of the stacks, relative to the root
+const DefaultLogDir = ".wrapter/logs"
+
+// BatchOptions configure how batch commands run over the stack directories
+type BatchOptions struct {
+	Parallelism  int           // Number of directories processed at once, at least 1
+	LogDir       string        // Directory of the per stack log files, DefaultLogDir in the root when empty
+	KeepGoing    bool          // Process every directory even after a failure
+	WarnOnly     bool          // Report failures as a warning instead of an error, implies KeepGoing
+	StackTimeout time.Duration // Time limit of each directory, none when zero
+}
+
+// Stack results of the batch summary
+const (
+	ResultPassed  = "passed"
+	ResultFailed  = "failed"
+	ResultSkipped = "skipped"
+)
+
+// stackResult is the outcome of a command in a stack
+type stackResult struct {
+	Name       string
+	Result     string
+	Duration   time.Duration
+	Err        error
+	FirstError string // Error shown in the summary, see summarizeFailure
+}
+
+// batchJob is the work of a batch command in one directory. Its output is written line by line
+// to the terminal, prefixed with the stack name, and to the stack's log file.
+type batchJob struct {
+	ctx         context.Context
+	cfg         *config.Config
+	Dir         string
+	Name        string // Stack ID, or the path relative to the root for other directories
+	stdout      *prefixWriter
+	stderr      *prefixWriter
+	pluginCache bool // Provider installs go through the shared plugin cache and must not overlap
+}
+
+// pluginCacheMu serializes provider installs when a plugin cache is configured: OpenTofu does
+// not guarantee that concurrent `tofu init` runs sharing the cache leave it consistent
+var pluginCacheMu sync.Mutex
+
+// outputMu keeps the lines of concurrent jobs from interleaving
+var outputMu sync.Mutex
+
+var pluginCacheDirPattern = regexp.MustCompile(`(?m)^\s*plugin_cache_dir\s*=\s*"([^"]*)"`)
+
+// Println prints a message to the output of the job
+func (j *batchJob) Println(args ...interface{}) {
+	fmt.Fprintln(j.stdout, args...)
+}
+
+// run runs a command in the directory of the job
+func (j *batchJob) run(name string, args ...string) error {
+	return CommandRunner.Run(j.ctx, &Invocation{
+		Name:   name,
+		Args:   args,
+		Env:    toolEnv(j.cfg),
+		Dir:    j.Dir,
+		Stdout: j.stdout,
+		Stderr: j.stderr,
+	})
+}
+
+// install runs a command that installs providers, such as `tofu init`, one at a time when
+// they share a plugin cache
+func (j *batchJob) install(name string, args ...string) error {
+	if j.pluginCache {
+		pluginCacheMu.Lock()
+		defer pluginCacheMu.Unlock()
+	}
+	return j.run(name, args...)
+}
+
+// runBatch runs task in every directory with up to opts.Parallelism jobs at once. Once a job
+// fails no other is started unless opts.KeepGoing or opts.WarnOnly is set; once ctx is done,
+// none at all. A summary of the results is printed when there are several directories.
+func runBatch(ctx context.Context, cfg *config.Config, dirs []string, opts BatchOptions, command string, task func(job *batchJob) error) error {
+	parallelism := opts.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	logDir := opts.LogDir
+	if logDir == "" {
+		logDir = filepath.Join(cfg.Root, DefaultLogDir)
+	}
+	logDir = filepath.Join(logDir, command)
+
+	pluginCache, err := preparePluginCache(cfg)
+	if err != nil {
+		return err
+	}
+
+	resolver := config.NewResolver(cfg)
+	results := make([]*stackResult, len(dirs))
+	for i, dir := range dirs {
+		results[i] = &stackResult{Name: resolver.StackName(dir), Result: ResultSkipped}
+	}
+
+	var failed bool
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, parallelism)
+schedule:
+	for i, dir := range dirs {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			break schedule
+		}
+		mu.Lock()
+		stop := failed && !opts.KeepGoing && !opts.WarnOnly
+		mu.Unlock()
+		if stop || ctx.Err() != nil {
+			<-slots
+			break
+		}
+
+		wg.Add(1)
+		go func(result *stackResult, dir string) {
+			defer func() { <-slots; wg.Done() }()
+
+			jobCtx, cancel := stackContext(ctx, opts.StackTimeout)
+			defer cancel()
+			start := time.Now()
+			firstError, err := runJob(jobCtx, cfg, dir, result.Name, logDir, pluginCache, task)
+			mu.Lock()
+			defer mu.Unlock()
+			result.Duration = time.Since(start)
+			result.Result = ResultPassed
+			if err != nil {
+				result.Result = ResultFailed
+				result.Err = err
+				result.FirstError = summarizeFailure(jobCtx, firstError, err)
+				failed = true
+			}
+		}(results[i], dir)
+	}
+	wg.Wait()
+
+	if len(dirs) > 1 {
+		printSummary(os.Stdout, results)
+	}
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+
+	var failures []*stackResult
+	for _, result := range results {
+		if result.Result == ResultFailed {
+			failures = append(failures, result)
+		}
+	}
+	switch {
+	case len(failures) == 0:
+		return nil
+	case opts.WarnOnly:
+		fmt.Fprintf(os.Stderr, "Warning: %d of %d stack(s) failed, ignored because ALLOW_FAIL_VALIDATION is set\n", len(failures), len(dirs))
+		return nil
+	case len(dirs) == 1:
+		return fmt.Errorf("%s: %w", failures[0].Name, failures[0].Err)
+	default:
+		return fmt.Errorf("%d of %d stack(s) failed", len(failures), len(dirs))
+	}
+}
+
+// runJob runs task in a directory with the configuration applying to it, writing its output to the terminal and to its log file. It
+// returns the first line the task wrote to stderr, to summarize failures.
+func runJob(ctx context.Context, cfg *config.Config, dir, name, logDir string, pluginCache bool, task func(job *batchJob) error) (string, error) {
+	logName := name
+	if logName == "." {
+		logName = "root"
+	}
+	stackCfg, err := cfg.ForDir(dir)
+	if err != nil {
+		return "", err
+	}
+	log, err := createLog(filepath.Join(logDir, filepath.FromSlash(logName)+".log"))
+	if err != nil {
+		return "", err
+	}
+	defer log.Close()
+
+	prefix := "[" + name + "] "
+	job := &batchJob{
+		ctx:         ctx,
+		cfg:         stackCfg,
+		Dir:         dir,
+		Name:        name,
+		stdout:      &prefixWriter{out: os.Stdout, log: log, prefix: prefix},
+		stderr:      &prefixWriter{out: os.Stderr, log: log, prefix: prefix},
+		pluginCache: pluginCache,
+	}
+	err = task(job)
+	job.stdout.Flush()
+	job.stderr.Flush()
+	return job.stderr.firstLine, err
+}
+
+// createLog creates the log file of a job along with its directory. Dry runs write no log.
+func createLog(path string) (io.WriteCloser, error) {
+	if DryRun {
+		return nopWriteCloser{io.Discard}, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("could not create the log directory: %w", err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not create the log file: %w", err)
+	}
+	return file, nil
+}
+
+// nopWriteCloser adds a Close method doing nothing to a writer
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// stackContext returns the context of a stack, limited to timeout when it isn't zero
+func stackContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, timeout, fmt.Errorf("stack timed out after %s", timeout))
+}
+
+// preparePluginCache reports whether a plugin cache is configured, through TF_PLUGIN_CACHE_DIR
+// or the CLI configuration, and creates its directory, which OpenTofu expects to exist, unless
+// this is a dry run
+func preparePluginCache(cfg *config.Config) (bool, error) {
+	dir := os.Getenv("TF_PLUGIN_CACHE_DIR")
+	if dir == "" {
+		data, err := os.ReadFile(cfg.TerraformCliConfigPath)
+		if err != nil {
+			return false, nil // No CLI configuration, no cache
+		}
+		match := pluginCacheDirPattern.FindSubmatch(data)
+		if match == nil {
+			return false, nil
+		}
+		dir = os.ExpandEnv(string(match[1]))
+	}
+
+	if DryRun {
+		return true, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, fmt.Errorf("could not create the plugin cache directory: %w", err)
+	}
+	return true, nil
+}
+
+// prefixWriter writes complete lines to out with a prefix, and as they are to log
+type prefixWriter struct {
+	out       io.Writer
+	log       io.Writer
+	prefix    string
+	buf       []byte
+	firstLine string // First non blank line written
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.writeLine(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes the last line when it isn't terminated
+func (w *prefixWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.writeLine(append(w.buf, '\n'))
+		w.buf = nil
+	}
+}
+
+func (w *prefixWriter) writeLine(line []byte) {
+	if w.firstLine == "" {
+		w.firstLine = strings.TrimSpace(string(line))
+	}
+
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	io.WriteString(w.out, w.prefix+string(line))
+	w.log.Write(line)
+}
+
+// summarizeFailure returns the error of a failed stack shown in the summary. When the stack or
+// the whole command timed out, that is the timeout, since the output of the interrupted tool
+// only tells that it was interrupted. Otherwise it is the first line of the error output, the
+// error itself when there is none.
+func summarizeFailure(ctx context.Context, firstError string, err error) string {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return context.Cause(ctx).Error()
+	}
+	if firstError == "" {
+		return err.Error()
+	}
+	return firstError
+}
+
+// printSummary prints a table of the results of a command over several stacks
+func printSummary(out io.Writer, results []*stackResult) {
+	counts := map[string]int{}
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "\nSTACK\tRESULT\tDURATION\tERROR")
+	for _, result := range results {
+		counts[result.Result]++
+		duration, firstError := "-", ""
+		if result.Result != ResultSkipped {
+			duration = result.Duration.Round(time.Millisecond).String()
+		}
+		if result.Result == ResultFailed {
+			firstError = result.FirstError
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", result.Name, result.Result, duration, firstError)
+	}
+	writer.Flush()
+	fmt.Fprintf(out, "%d passed, %d failed, %d skipped\n", counts[ResultPassed], counts[ResultFailed], counts[ResultSkipped])
+}
@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummarizeFailure(t *testing.T) {
+	interrupted := errors.New("exit status 1")
+
+	stackCtx, cancel := stackContext(context.Background(), time.Millisecond)
+	defer cancel()
+	<-stackCtx.Done()
+
+	commandCtx, cancelCommand := context.WithTimeoutCause(context.Background(), time.Millisecond, fmt.Errorf("command timed out after 1ms"))
+	defer cancelCommand()
+	jobCtx, cancelJob := stackContext(commandCtx, time.Hour)
+	defer cancelJob()
+	<-jobCtx.Done()
+
+	interruptedCtx, interrupt := context.WithCancelCause(context.Background())
+	interrupt(errors.New("interrupted"))
+
+	for _, test := range []struct {
+		name       string
+		ctx        context.Context
+		firstError string
+		want       string
+	}{
+		{"stack timeout", stackCtx, "Interrupt received.", "stack timed out after 1ms"},
+		{"command timeout", jobCtx, "Interrupt received.", "command timed out after 1ms"},
+		{"interrupted", interruptedCtx, "Interrupt received.", "Interrupt received."},
+		{"error output", context.Background(), "Error: Invalid reference", "Error: Invalid reference"},
+		{"no error output", context.Background(), "", "exit status 1"},
+	} {
+		if summary := summarizeFailure(test.ctx, test.firstError, interrupted); summary != test.want {
+			t.Errorf("%s: summary %q, want %q", test.name, summary, test.want)
+		}
+	}
+}
+
+func TestRunBatchStackTimeout(t *testing.T) {
+	cfg := testRepository(t, testConfig, "111111111111/prod/us-east-1/pay/ledger", "111111111111/prod/us-east-1/pay/api")
+	dirs := []string{
+		filepath.Join(cfg.Root, "111111111111/prod/us-east-1/pay/api"),
+		filepath.Join(cfg.Root, "111111111111/prod/us-east-1/pay/ledger"),
+	}
+
+	// The summary goes to the standard output
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+
+	opts := BatchOptions{KeepGoing: true, StackTimeout: 10 * time.Millisecond, LogDir: t.TempDir()}
+	err = runBatch(context.Background(), cfg, dirs, opts, "test", func(job *batchJob) error {
+		if strings.HasSuffix(job.Dir, "ledger") {
+			return nil
+		}
+		// Like tofu when it gets SIGINT
+		<-job.ctx.Done()
+		fmt.Fprintln(job.stderr, "Interrupt received.")
+		return errors.New("exit status 1")
+	})
+	writer.Close()
+	os.Stdout = stdout
+	output, _ := io.ReadAll(reader)
+
+	if err == nil {
+		t.Fatal("runBatch succeeded despite the timeout")
+	}
+	var failure string
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "prod/us-east-1/pay/api ") {
+			failure = line
+		}
+	}
+	if !strings.Contains(failure, "failed") || !strings.HasSuffix(strings.TrimSpace(failure), "stack timed out after 10ms") {
+		t.Errorf("summary line %q doesn't report the timeout, output:\n%s", failure, output)
+	}
+}
+
+func TestPrintSummary(t *testing.T) {
+	var out bytes.Buffer
+	printSummary(&out, []*stackResult{
+		{Name: "prod/us-east-1/pay/ledger", Result: ResultPassed, Duration: 1500 * time.Millisecond},
+		{Name: "prod/us-east-1/pay/api", Result: ResultFailed, Duration: time.Minute, FirstError: "stack timed out after 1m0s"},
+		{Name: "prod/us-east-1/pay/web", Result: ResultSkipped},
+	})
+
+	want := []string{
+		"STACK                      RESULT   DURATION  ERROR",
+		"prod/us-east-1/pay/ledger  passed   1.5s",
+		"prod/us-east-1/pay/api     failed   1m0s      stack timed out after 1m0s",
+		"prod/us-east-1/pay/web     skipped  -",
+		"1 passed, 1 failed, 1 skipped",
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		lines = append(lines, strings.TrimRight(line, " "))
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("summary:\n%s\nwant:\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,325 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"wrapter/config"
+)
+
+// RemoteState is a terraform_remote_state data source read by a stack
+type RemoteState struct {
+	Name  string `json:"name"`
+	State string `json:"state"`           // State key, address or path the data source reads
+	Stack string `json:"stack,omitempty"` // ID of the stack owning that state, empty if none does
+}
+
+// StackNode is a stack of the dependency graph
+type StackNode struct {
+	ID           string         `json:"id"`
+	DependsOn    []string       `json:"depends_on"`
+	RemoteStates []*RemoteState `json:"remote_states"`
+}
+
+// StackGraph is the dependency graph of the stacks: a stack depends on the stacks whose state
+// it reads through terraform_remote_state data sources
+type StackGraph struct {
+	Stacks []*StackNode `json:"stacks"`
+	nodes  map[string]*StackNode
+}
+
+var (
+	remoteStatePattern = regexp.MustCompile(`data\s+"terraform_remote_state"\s+"([^"]+)"\s*\{`)
+	stateRefPattern    = regexp.MustCompile(`\b(key|address|path)\s*=\s*"([^"]*)"`)
+)
+
+// BuildGraph parses the terraform_remote_state data sources of every stack of the inventory
+// and matches the state they read to the state keys of the stacks
+func BuildGraph(cfg *config.Config) (*StackGraph, error) {
+	inventory, err := Inventory(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stacks whose environment can't be resolved have no known state key and can't be depended on
+	stateKeys := map[string]string{}
+	for _, info := range inventory {
+		stackCfg, err := cfg.ForDir(info.Dir)
+		if err != nil {
+			return nil, err
+		}
+		if target, err := config.NewResolver(stackCfg).Resolve("", info.Dir); err == nil {
+			stateKeys[info.ID] = target.StateKey
+		}
+	}
+
+	graph := &StackGraph{Stacks: []*StackNode{}, nodes: map[string]*StackNode{}}
+	for _, info := range inventory {
+		code, err := readTerraformFiles(info.Dir)
+		if err != nil {
+			return nil, err
+		}
+
+		node := &StackNode{ID: info.ID, DependsOn: []string{}, RemoteStates: []*RemoteState{}}
+		for _, remoteState := range parseRemoteStates(code) {
+			for _, id := range sortedKeys(stateKeys) {
+				key := stateKeys[id]
+				if id != info.ID && (remoteState.State == key || strings.HasSuffix(remoteState.State, "/"+key)) {
+					remoteState.Stack = id
+					if !contains(node.DependsOn, id) {
+						node.DependsOn = append(node.DependsOn, id)
+					}
+					break
+				}
+			}
+			node.RemoteStates = append(node.RemoteStates, remoteState)
+		}
+		sort.Strings(node.DependsOn)
+
+		graph.Stacks = append(graph.Stacks, node)
+		graph.nodes[node.ID] = node
+	}
+	return graph, nil
+}
+
+// parseRemoteStates returns the terraform_remote_state data sources of Terraform code
+func parseRemoteStates(code string) []*RemoteState {
+	var remoteStates []*RemoteState
+	for _, match := range remoteStatePattern.FindAllStringSubmatchIndex(code, -1) {
+		body := blockBody(code[match[1]:])
+		remoteState := &RemoteState{Name: code[match[2]:match[3]]}
+		if ref := stateRefPattern.FindStringSubmatch(body); ref != nil {
+			remoteState.State = ref[2]
+		}
+		remoteStates = append(remoteStates, remoteState)
+	}
+	return remoteStates
+}
+
+// blockBody returns the body of an HCL block up to its closing brace, code starting right
+// after the opening one. Braces inside strings and comments are ignored.
+func blockBody(code string) string {
+	depth := 1
+	inString, inComment := false, false
+	for i := 0; i < len(code); i++ {
+		switch c := code[i]; {
+		case inComment:
+			inComment = c != '\n'
+		case inString:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '#':
+			inComment = true
+		case c == '{':
+			depth++
+		case c == '}':
+			if depth--; depth == 0 {
+				return code[:i]
+			}
+		}
+	}
+	return code
+}
+
+// Order returns the given stack IDs in dependency order, dependencies first and otherwise by ID.
+// Dependencies that aren't among the given stacks still order the ones that are.
+func (g *StackGraph) Order(ids []string) ([]string, error) {
+	// Kahn's algorithm over the whole graph, taking the smallest ready ID first
+	pending := map[string]int{}
+	dependents := map[string][]string{}
+	for _, node := range g.Stacks {
+		pending[node.ID] += 0
+		for _, dependency := range node.DependsOn {
+			if _, exists := g.nodes[dependency]; !exists {
+				continue // Can't be ordered, nor wait for
+			}
+			pending[node.ID]++
+			dependents[dependency] = append(dependents[dependency], node.ID)
+		}
+	}
+
+	var ready, order []string
+	for id, count := range pending {
+		if count == 0 {
+			ready = append(ready, id)
+		}
+	}
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		id := ready[0]
+		ready = ready[1:]
+		order = append(order, id)
+		for _, dependent := range dependents[id] {
+			if pending[dependent]--; pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	if len(order) < len(pending) {
+		var cycle []string
+		for id, count := range pending {
+			if count > 0 {
+				cycle = append(cycle, id)
+			}
+		}
+		sort.Strings(cycle)
+		return nil, fmt.Errorf("dependency cycle between stacks: %s", strings.Join(cycle, ", "))
+	}
+
+	// Stacks outside the graph, e.g. without Terraform files yet, keep their place by ID
+	selected := map[string]bool{}
+	for _, id := range ids {
+		selected[id] = true
+	}
+	var result, unknown []string
+	for _, id := range order {
+		if selected[id] {
+			result = append(result, id)
+			delete(selected, id)
+		}
+	}
+	for id := range selected {
+		unknown = append(unknown, id)
+	}
+	sort.Strings(unknown)
+	return append(result, unknown...), nil
+}
+
+// BlockedBy returns the failed stack that id depends on, directly or through other stacks, if any
+func (g *StackGraph) BlockedBy(id string, failed map[string]bool) string {
+	visited := map[string]bool{}
+	var walk func(string) string
+	walk = func(current string) string {
+		node, exists := g.nodes[current]
+		if !exists || visited[current] {
+			return ""
+		}
+		visited[current] = true
+		for _, dependency := range node.DependsOn {
+			if failed[dependency] {
+				return dependency
+			}
+			if blocker := walk(dependency); blocker != "" {
+				return blocker
+			}
+		}
+		return ""
+	}
+	return walk(id)
+}
+
+// DOT renders the graph in the Graphviz DOT language, edges pointing to dependencies
+func (g *StackGraph) DOT() string {
+	var sb strings.Builder
+	sb.WriteString("digraph stacks {\n")
+	sb.WriteString("  rankdir = \"LR\";\n")
+	for _, node := range g.Stacks {
+		sb.WriteString(fmt.Sprintf("  %q;\n", node.ID))
+	}
+	for _, node := range g.Stacks {
+		for _, dependency := range node.DependsOn {
+			sb.WriteString(fmt.Sprintf("  %q -> %q;\n", node.ID, dependency))
+		}
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// RunInOrder runs fn on the stacks in dependency order, each one within stackTimeout unless it
+// is zero. When a stack fails the stacks depending on it are skipped, the others still run;
+// once ctx is done the remaining ones are skipped. The returned error summarizes the failures.
+func RunInOrder(ctx context.Context, cfg *config.Config, stacks []*config.Stack, stackTimeout time.Duration, fn func(ctx context.Context, stack *config.Stack) error) error {
+	graph, err := BuildGraph(cfg)
+	if err != nil {
+		return fmt.Errorf("could not build the stack dependency graph: %w", err)
+	}
+
+	byID := map[string]*config.Stack{}
+	ids := make([]string, 0, len(stacks))
+	for _, stack := range stacks {
+		byID[stack.ID] = stack
+		ids = append(ids, stack.ID)
+	}
+	order, err := graph.Order(ids)
+	if err != nil {
+		return err
+	}
+
+	failed := map[string]bool{}
+	var failures, skipped []string
+	results := make([]*stackResult, 0, len(order))
+	for _, id := range order {
+		result := &stackResult{Name: id, Result: ResultSkipped}
+		results = append(results, result)
+		if ctx.Err() != nil {
+			skipped = append(skipped, id)
+			continue
+		}
+		if blocker := graph.BlockedBy(id, failed); blocker != "" {
+			fmt.Printf("Skipping %s: it depends on %s, which failed\n", id, blocker)
+			failed[id] = true
+			skipped = append(skipped, id)
+			continue
+		}
+
+		fmt.Println("Stack:", id)
+		stackCtx, cancel := stackContext(ctx, stackTimeout)
+		start := time.Now()
+		err := fn(stackCtx, byID[id])
+		result.Duration = time.Since(start)
+		result.Result = ResultPassed
+		if err != nil {
+			fmt.Printf("Stack %s failed: %v\n", id, err)
+			result.Result = ResultFailed
+			result.Err = err
+			result.FirstError = summarizeFailure(stackCtx, "", err)
+			failed[id] = true
+			failures = append(failures, id)
+		}
+		cancel()
+	}
+	if len(results) > 1 {
+		printSummary(os.Stdout, results)
+	}
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+
+	if len(failures) > 0 {
+		message := fmt.Sprintf("%d stack(s) failed: %s", len(failures), strings.Join(failures, ", "))
+		if len(skipped) > 0 {
+			message += fmt.Sprintf("; %d skipped: %s", len(skipped), strings.Join(skipped, ", "))
+		}
+		return fmt.Errorf("%s", message)
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of a map in sorted order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// contains reports whether a slice holds the value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newGraph builds a graph from the dependencies of each stack
+func newGraph(dependencies map[string][]string) *StackGraph {
+	graph := &StackGraph{nodes: map[string]*StackNode{}}
+	for id := range dependencies {
+		node := &StackNode{ID: id, DependsOn: dependencies[id]}
+		graph.Stacks = append(graph.Stacks, node)
+		graph.nodes[id] = node
+	}
+	return graph
+}
+
+// diamond is a stack read by two others, both read by a fourth one
+var diamond = map[string][]string{
+	"prod/pay/base":   nil,
+	"prod/pay/left":   {"prod/pay/base"},
+	"prod/pay/right":  {"prod/pay/base"},
+	"prod/pay/bottom": {"prod/pay/left", "prod/pay/right"},
+}
+
+func TestOrder(t *testing.T) {
+	graph := newGraph(diamond)
+	for _, test := range []struct {
+		ids  []string
+		want []string
+	}{
+		{
+			ids:  []string{"prod/pay/bottom", "prod/pay/right", "prod/pay/left", "prod/pay/base"},
+			want: []string{"prod/pay/base", "prod/pay/left", "prod/pay/right", "prod/pay/bottom"},
+		},
+		{
+			// The dependencies between the selected stacks go through unselected ones
+			ids:  []string{"prod/pay/bottom", "prod/pay/base"},
+			want: []string{"prod/pay/base", "prod/pay/bottom"},
+		},
+		{
+			// Stacks outside the graph come last, by ID
+			ids:  []string{"prod/pay/new", "prod/pay/bottom", "prod/pay/extra"},
+			want: []string{"prod/pay/bottom", "prod/pay/extra", "prod/pay/new"},
+		},
+	} {
+		order, err := graph.Order(test.ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(order, test.want) {
+			t.Errorf("Order(%v) = %v, want %v", test.ids, order, test.want)
+		}
+	}
+}
+
+func TestOrderCycle(t *testing.T) {
+	graph := newGraph(map[string][]string{
+		"prod/pay/a": {"prod/pay/c"},
+		"prod/pay/b": {"prod/pay/a"},
+		"prod/pay/c": {"prod/pay/b"},
+		"prod/pay/d": nil,
+	})
+	_, err := graph.Order([]string{"prod/pay/d"})
+	if err == nil {
+		t.Fatal("Order accepted a dependency cycle")
+	}
+	if want := "dependency cycle between stacks: prod/pay/a, prod/pay/b, prod/pay/c"; err.Error() != want {
+		t.Errorf("error %q, want %q", err, want)
+	}
+}
+
+func TestOrderMissingDependency(t *testing.T) {
+	graph := newGraph(map[string][]string{
+		"prod/pay/ledger": {"prod/pay/removed"},
+		"prod/pay/api":    {"prod/pay/ledger"},
+	})
+	order, err := graph.Order([]string{"prod/pay/api", "prod/pay/ledger"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"prod/pay/ledger", "prod/pay/api"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("order %v, want %v", order, want)
+	}
+}
+
+func TestBlockedBy(t *testing.T) {
+	graph := newGraph(diamond)
+	for _, test := range []struct {
+		failed []string
+		id     string
+		want   string
+	}{
+		{[]string{"prod/pay/left"}, "prod/pay/bottom", "prod/pay/left"},
+		{[]string{"prod/pay/left"}, "prod/pay/right", ""},
+		{[]string{"prod/pay/base"}, "prod/pay/bottom", "prod/pay/base"},
+		{[]string{"prod/pay/bottom"}, "prod/pay/base", ""},
+		{nil, "prod/pay/bottom", ""},
+		{[]string{"prod/pay/base"}, "prod/pay/unknown", ""},
+	} {
+		failed := map[string]bool{}
+		for _, id := range test.failed {
+			failed[id] = true
+		}
+		if blocker := graph.BlockedBy(test.id, failed); blocker != test.want {
+			t.Errorf("BlockedBy(%s) with %v failed = %q, want %q", test.id, test.failed, blocker, test.want)
+		}
+	}
+}
+
+func TestParseRemoteStates(t *testing.T) {
+	code := `
+data "terraform_remote_state" "common" {
+  backend = "s3"
+  config = {
+    bucket = "company-tfstates"
+    key    = "company/111111111111/prod/us-east-1/pay/ledger/service.tfstate"
+  }
+}
+
+data "terraform_remote_state" "consul" {
+  backend = "consul"
+  # a comment with a } brace
+  config = {
+    path    = "wrapter/prod/pay/api"
+    address = "consul:8500"
+    scheme  = "http{s}"
+  }
+}
+
+data "terraform_remote_state" "http" {
+  backend = "http"
+  config = {
+    address = "https://state.example.com/prod/pay/api"
+  }
+}
+
+data "terraform_remote_state" "dynamic" {
+  backend = "s3"
+  config  = var.state_config
+}
+`
+	want := []RemoteState{
+		{Name: "common", State: "company/111111111111/prod/us-east-1/pay/ledger/service.tfstate"},
+		{Name: "consul", State: "wrapter/prod/pay/api"},
+		{Name: "http", State: "https://state.example.com/prod/pay/api"},
+		{Name: "dynamic"},
+	}
+	var got []RemoteState
+	for _, remoteState := range parseRemoteStates(code) {
+		got = append(got, *remoteState)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseRemoteStates() = %+v, want %+v", got, want)
+	}
+}
+
+func TestBuildGraph(t *testing.T) {
+	ledger := "111111111111/prod/us-east-1/pay/ledger"
+	cfg := testRepository(t, testConfig, ledger, ledger+"-custom", "111111111111/prod/us-east-1/pay/api")
+	writeRemoteState := func(stack, key string) {
+		t.Helper()
+		code := `data "terraform_remote_state" "common" {
+  backend = "s3"
+  config = {
+    key = "` + key + `"
+  }
+}
+`
+		if err := os.WriteFile(filepath.Join(cfg.Root, filepath.FromSlash(stack), "remote.tf"), []byte(code), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeRemoteState(ledger+"-custom", "company/"+ledger+"/service.tfstate")
+	writeRemoteState("111111111111/prod/us-east-1/pay/api", "company/111111111111/prod/us-east-1/pay/removed/service.tfstate")
+
+	graph, err := BuildGraph(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dependencies := map[string]string{}
+	states := map[string]string{}
+	for _, node := range graph.Stacks {
+		dependencies[node.ID] = strings.Join(node.DependsOn, ",")
+		for _, remoteState := range node.RemoteStates {
+			states[node.ID] = remoteState.Stack
+		}
+	}
+	want := map[string]string{
+		"prod/us-east-1/pay/api":           "",
+		"prod/us-east-1/pay/ledger":        "",
+		"prod/us-east-1/pay/ledger-custom": "prod/us-east-1/pay/ledger",
+	}
+	if !reflect.DeepEqual(dependencies, want) {
+		t.Errorf("dependencies %v, want %v", dependencies, want)
+	}
+	// A state no stack owns is kept without a stack
+	if stack, exists := states["prod/us-east-1/pay/api"]; !exists || stack != "" {
+		t.Errorf("remote state of api: stack %q, exists %v", stack, exists)
+	}
+}
@@ -2,199 +2,124 @@ package utils
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
-	"reflect"
 	"strings"
-	"wrapter/common"
 	"wrapter/config"
 
 	"github.com/AlecAivazis/survey/v2"
 )
 
-// ConstructStateKey constructs the state key for the Terraform backend configuration
-func ConstructStateKey(project, currentDir string, cfg *config.Config) (string, error) {
-	// Clean the current directory path to ensure it's in a standard format
-	cleanDir := filepath.Clean(currentDir)
-
-	// Extract the environment from the path
-	environment := ExtractEnvironmentFromPath(cleanDir)
-	if environment == "" {
-		return "", fmt.Errorf("unable to determine environment from path: %s", cleanDir)
-	}
-
-	fmt.Printf("Extracted environment: %s\n", environment) // Debugging statement
-
-	// Dynamically get the account ID from the profiles using the environment string
-	accountID, err := getFieldValueByEnvironment(cfg.Profiles, environment)
-	if err != nil {
-		return "", err
-	}
-
-	// Get the region from the default_regions based on the account ID
-	region, exists := cfg.DefaultRegions[accountID]
-	if !exists {
-		return "", fmt.Errorf("region not found for account ID: %s", accountID)
-	}
-
-	// Construct the expected prefix (account ID, environment, region)
-	expectedPrefix := filepath.Join(accountID, environment, region)
-
-	fmt.Printf("Expected prefix: %s\n", expectedPrefix) // Debugging statement
-
-	// Find the relative service path after the expected prefix
-	startIdx := strings.Index(cleanDir, expectedPrefix)
-	if startIdx == -1 {
-		return "", fmt.Errorf("directory path does not match expected prefix: %s", expectedPrefix)
-	}
-	// The service path is everything after the expected prefix
-	relativeServicePath := strings.TrimPrefix(cleanDir[startIdx+len(expectedPrefix):], string(filepath.Separator))
-
-	// Construct the final state key
-	stateKey := filepath.Join(project, expectedPrefix, relativeServicePath, "service.tfstate")
-
-	fmt.Printf("Constructed state key: %s\n", stateKey) // Debugging statement
-
-	return stateKey, nil
-}
-
-// ConstructCustomStateKey constructs the state key for the custom Terraform backend configuration
-func ConstructCustomStateKey(project, currentDir, teamName, serviceName string, cfg *config.Config) (string, error) {
-	// Clean the current directory path to ensure it's in a standard format
-	cleanDir := filepath.Clean(currentDir)
-
-	// Extract the environment from the path
-	environment := ExtractEnvironmentFromPath(cleanDir)
-	if environment == "" {
-		return "", fmt.Errorf("unable to determine environment from path: %s", cleanDir)
-	}
-
-	fmt.Printf("Extracted environment: %s\n", environment) // Debugging statement
-
-	// Dynamically get the account ID from the profiles using the environment string
-	accountID, err := getFieldValueByEnvironment(cfg.Profiles, environment)
+// ListDirs lists the directories below the current one that contain Terraform or OpenTofu files.
+// Hidden directories such as .git and .terraform, paths ignored by .wrapterignore files and
+// directories outside the discovery globs of the configuration are skipped.
+func ListDirs(cfg *config.Config) ([]string, error) {
+	cwd, err := os.Getwd()
 	if err != nil {
-		return "", err
-	}
-
-	// Get the region from the default_regions based on the account ID
-	region, exists := cfg.DefaultRegions[accountID]
-	if !exists {
-		return "", fmt.Errorf("region not found for account ID: %s", accountID)
-	}
-
-	// Construct the expected prefix (account ID, environment, region)
-	expectedPrefix := filepath.Join(accountID, environment, region)
-
-	fmt.Printf("Expected prefix: %s\n", expectedPrefix) // Debugging statement
-
-	// Construct the final state key
-	stateKey := filepath.Join(project, expectedPrefix, teamName, serviceName, "service.tfstate")
-
-	fmt.Printf("Constructed state key: %s\n", stateKey) // Debugging statement
-
-	return stateKey, nil
-}
-
-
-// getFieldValueByEnvironment uses reflection to get the value of the field in the Profiles struct based on the environment string
-func getFieldValueByEnvironment(profiles interface{}, environment string) (string, error) {
-	// Define a mapping from lowercase environment names to struct field names
-	envToFieldName := map[string]string{
-		"dev":    "Dev",
-		"stable": "Stable",
-		"prod":   "Prod",
-		"mgmt":   "Mgmt",
+		return nil, err
 	}
 
-	fieldName, exists := envToFieldName[strings.ToLower(environment)]
-	if !exists {
-		return "", fmt.Errorf("no profile found for environment: %s", environment)
-	}
-
-	// fmt.Printf("Looking for environment: %s (converted to: %s)\n", environment, fieldName) // Debugging statement
-
-	r := reflect.ValueOf(profiles)
-	f := reflect.Indirect(r).FieldByName(fieldName)
-	if !f.IsValid() {
-		return "", fmt.Errorf("no profile found for environment: %s", environment)
+	// Ignore files and discovery globs are relative to the root; outside of it, for example with
+	// --config pointing elsewhere, only the ignore files below the current directory apply
+	root, discovery := cfg.Root, cfg.Discovery
+	base, err := filepath.Rel(root, cwd)
+	if err != nil || base == ".." || strings.HasPrefix(base, ".."+string(filepath.Separator)) {
+		root, discovery, base = cwd, config.DiscoverySettings{}, "."
 	}
-	return f.String(), nil
-}
-
-// ExtractAccountIDAndRegionFromPath extracts the account ID and region from the directory path
-func ExtractAccountIDAndRegionFromPath(path string) (string, string, error) {
-	// Split the path into segments
-	segments := strings.Split(filepath.Clean(path), string(filepath.Separator))
+	base = filepath.ToSlash(base)
 
-	if len(segments) < 6 {
-		return "", "", fmt.Errorf("insufficient directory segments to determine account ID and region")
+	rules := newIgnoreRules(root)
+	excluded, err := rules.excluded(base)
+	if err != nil || excluded || discovery.Excludes(base) {
+		return nil, err
 	}
 
-	// Assume the account ID is the 5th segment and region is the 6th segment
-	accountID := segments[4]
-	region := segments[5]
-
-	return accountID, region, nil
-}
+	var dirs []string
+	err = filepath.WalkDir(".", func(dir string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if dir != "." && isHidden(entry.Name()) {
+			return filepath.SkipDir
+		}
 
-// ExtractEnvironmentFromPath extracts the environment from the directory path
-func ExtractEnvironmentFromPath(path string) string {
-	// Split the path into segments
-	segments := strings.Split(filepath.Clean(path), string(filepath.Separator))
-
-	// Assuming the structure /home/freshly/gitlab/diftech/scripts/111111111/prod/us-east-1/dwh/airbyte
-	// We take the segment just before the region (e.g., 'prod' in this case)
-	// Adjust the index based on your actual directory depth
-	for i, segment := range segments {
-		if isRegion(segment) {
-			if i > 0 {
-				return segments[i-1]
+		rel := path.Join(base, filepath.ToSlash(dir))
+		if rel != "." {
+			ignored, err := rules.ignored(rel, true)
+			if err != nil {
+				return err
+			}
+			if ignored || discovery.Excludes(rel) {
+				return filepath.SkipDir
 			}
 		}
-	}
-	return "" // Return an empty string if the environment can't be determined
-}
-
-// Helper function to identify if a string is a region code
-func isRegion(segment string) bool {
-	regions := []string{
-		"us-east-1", "us-west-2", "eu-central-1", // Add other regions as needed
-	}
-	for _, region := range regions {
-		if segment == region {
-			return true
+		if !discovery.Includes(rel) {
+			return nil
 		}
-	}
-	return false
-}
 
-// ListDirs lists all directories containing Terraform files, excluding .terraform directories and their subdirectories
-func ListDirs() ([]string, error) {
-	var dirs []string
-	err := filepath.Walk(".", func(path string, info os.FileInfo, err error) error {
+		found, err := hasTerraformFiles(dir, rules, rel)
 		if err != nil {
 			return err
 		}
-
-		// Exclude any directory that is part of a `.terraform` path
-		if info.IsDir() && strings.Contains(path, ".terraform") {
-			return filepath.SkipDir
-		}
-
-		// Add the directory if it passes the above checks
-		if info.IsDir() {
-			dirs = append(dirs, path)
+		if found {
+			dirs = append(dirs, dir)
 		}
 		return nil
 	})
 	return dirs, err
 }
 
+// DiscoverStacks keeps the stacks ListDirs would discover: those with Terraform or OpenTofu
+// files that neither .wrapterignore nor the discovery globs exclude
+func DiscoverStacks(cfg *config.Config, stacks []*config.Stack) ([]*config.Stack, error) {
+	rules := newIgnoreRules(cfg.Root)
+	var discovered []*config.Stack
+	for _, stack := range stacks {
+		rel, err := filepath.Rel(cfg.Root, stack.Dir)
+		if err != nil {
+			return nil, err
+		}
+		rel = filepath.ToSlash(rel)
+
+		excluded, err := rules.excluded(rel)
+		if err != nil {
+			return nil, err
+		}
+		if excluded || cfg.Discovery.Excludes(rel) || !cfg.Discovery.Includes(rel) {
+			continue
+		}
+		found, err := hasTerraformFiles(stack.Dir, rules, rel)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			discovered = append(discovered, stack)
+		}
+	}
+	return discovered, nil
+}
+
+// serviceComponents maps the components offered for common services to the module flags
+// enabling them, in the order they are written to main.tf
+var serviceComponents = []struct {
+	Name string
+	Flag string
+}{
+	{"PostgreSQL", "postgres_enabled"},
+	{"Mongo", "mongodb_enabled"},
+	{"Keycloak", "keycloak_enabled"},
+	{"AD", "ad_enabled"},
+}
+
 // Helper functions for prompts using the survey library
 // promptForEnvironments prompts the user to select environments
-func promptForEnvironments() ([]string, error) {
-	options := []string{"dev", "stable", "prod"}
+func promptForEnvironments(cfg *config.Config) ([]string, error) {
+	options := cfg.EnvironmentNames()
 	var selected []string
 	prompt := &survey.MultiSelect{
 		Message: "Choose environments:",
@@ -204,6 +129,21 @@ func promptForEnvironments() ([]string, error) {
 	return selected, err
 }
 
+// promptForRegions prompts the user to select the regions of an environment when its account declares several
+func promptForRegions(environment string, regions config.AccountRegions) ([]string, error) {
+	if len(regions.Regions) <= 1 {
+		return []string{regions.Default}, nil
+	}
+	var selected []string
+	prompt := &survey.MultiSelect{
+		Message: fmt.Sprintf("Choose regions for %s:", environment),
+		Options: regions.Regions,
+		Default: []string{regions.Default},
+	}
+	err := survey.AskOne(prompt, &selected, survey.WithValidator(survey.Required))
+	return selected, err
+}
+
 // promptForServiceType prompts the user to choose between new or custom service
 func promptForServiceType() (string, error) {
 	options := []string{"new", "custom"}
@@ -238,26 +178,20 @@ func promptForText(message string) (string, error) {
 }
 
 // createServiceFiles creates the directory structure and required files for the service
-func createServiceFiles(cfg *config.Config, environment, teamName, serviceName string, components []string) error {
-	accountID, region, err := getAccountAndRegion(cfg, environment)
+func createServiceFiles(cfg *config.Config, resolver *config.Resolver, target *config.Target, teamName, serviceName string, components []string) error {
+	// Build the target directory from the repository layout
+	targetDir, err := resolver.StackDir(target, teamName, serviceName)
 	if err != nil {
-		return fmt.Errorf("could not get account and region: %w", err)
-	}
-
-	// Determine the root directory for git
-	gitRoot, err := common.FindGitRoot()
-	if err != nil {
-		return fmt.Errorf("could not find git root: %w", err)
+		return fmt.Errorf("could not build service directory: %w", err)
 	}
 
 	// Create the target directory structure
-	targetDir := filepath.Join(gitRoot, accountID, environment, region, teamName, serviceName)
 	if err := CreateTargetDir(targetDir); err != nil {
 		return fmt.Errorf("could not create target directory %s: %w", targetDir, err)
 	}
 
 	// Generate and write locals.tf
-	if err := generateLocalsTF(targetDir, environment, teamName, serviceName, accountID, region); err != nil {
+	if err := generateLocalsTF(targetDir, target.Environment, teamName, serviceName, target.AccountID, target.Region); err != nil {
 		return fmt.Errorf("could not create locals.tf: %w", err)
 	}
 
@@ -266,9 +200,9 @@ func createServiceFiles(cfg *config.Config, environment, teamName, serviceName s
 		return fmt.Errorf("could not create main.tf: %w", err)
 	}
 
-	// Copy static provider.tf
-	if err := copyStaticFile("provider.tf", targetDir); err != nil {
-		return fmt.Errorf("could not copy provider.tf: %w", err)
+	// Generate and write provider.tf
+	if err := generateProviderTF(targetDir, target); err != nil {
+		return fmt.Errorf("could not create provider.tf: %w", err)
 	}
 
 	// Copy static variables.tf
@@ -279,28 +213,6 @@ func createServiceFiles(cfg *config.Config, environment, teamName, serviceName s
 	return nil
 }
 
-// getAccountAndRegion retrieves the account ID and region for a given environment
-func getAccountAndRegion(cfg *config.Config, environment string) (string, string, error) {
-	var accountID string
-	switch environment {
-	case "dev", "stable":
-		accountID = cfg.Profiles.Dev
-	case "prod":
-		accountID = cfg.Profiles.Prod
-	case "mgmt":
-		accountID = cfg.Profiles.Mgmt
-	default:
-		return "", "", fmt.Errorf("unknown environment: %s", environment)
-	}
-
-	region, exists := cfg.DefaultRegions[accountID]
-	if !exists {
-		return "", "", fmt.Errorf("region not found for account ID: %s", accountID)
-	}
-
-	return accountID, region, nil
-}
-
 // generateLocalsTF generates the locals.tf content and writes it to the target directory
 func generateLocalsTF(targetDir, environment, teamName, serviceName, accountID, region string) error {
 	localsContent := fmt.Sprintf(`locals {
@@ -328,28 +240,6 @@ func generateLocalsTF(targetDir, environment, teamName, serviceName, accountID,
 
 // generateMainTF generates the main.tf content and writes it to the target directory
 func generateMainTF(cfg *config.Config, targetDir string, components []string) error {
-	// Map of component flags
-	componentFlags := map[string]bool{
-		"postgres_enabled": false,
-		"mongodb_enabled":  false,
-		"keycloak_enabled": false,
-		"ad_enabled":       false,
-	}
-
-	// Set flags based on selected components
-	for _, component := range components {
-		switch component {
-		case "PostgreSQL":
-			componentFlags["postgres_enabled"] = true
-		case "Mongo":
-			componentFlags["mongodb_enabled"] = true
-		case "Keycloak":
-			componentFlags["keycloak_enabled"] = true
-		case "AD":
-			componentFlags["ad_enabled"] = true
-		}
-	}
-
 	// Use module_git_url and module_version from the configuration
 	moduleSource := fmt.Sprintf("%s?ref=%s", cfg.CommonService.ModuleGitURL, cfg.CommonService.ModuleVersion)
 
@@ -377,18 +267,13 @@ func generateMainTF(cfg *config.Config, targetDir string, components []string) e
   SERVICES_TOKEN       = var.SERVICES_TOKEN
 `, moduleSource))
 
-	// Conditionally add the component flags if they are enabled
-	if componentFlags["postgres_enabled"] {
-		sb.WriteString(fmt.Sprintf("  postgres_enabled     = %t\n", componentFlags["postgres_enabled"]))
-	}
-	if componentFlags["mongodb_enabled"] {
-		sb.WriteString(fmt.Sprintf("  mongodb_enabled      = %t\n", componentFlags["mongodb_enabled"]))
-	}
-	if componentFlags["keycloak_enabled"] {
-		sb.WriteString(fmt.Sprintf("  keycloak_enabled     = %t\n", componentFlags["keycloak_enabled"]))
-	}
-	if componentFlags["ad_enabled"] {
-		sb.WriteString(fmt.Sprintf("  ad_enabled           = %t\n", componentFlags["ad_enabled"]))
+	// Add the flags of the selected components
+	for _, component := range serviceComponents {
+		for _, selected := range components {
+			if selected == component.Name {
+				sb.WriteString(fmt.Sprintf("  %-20s = true\n", component.Flag))
+			}
+		}
 	}
 
 	// Close the module block
@@ -419,55 +304,32 @@ func generateCustomSettingsTF(targetDir, accountID string) error {
   services_secret_path = "services"
   secret               = "secret"
   callback_url         = "http://localhost:8080/callback"
-}
-
-variable "MINIO_ACCESS_KEY" {
-  type = string
-}
-variable "MINIO_SECRET_KEY" {
-  type = string
 }`, accountID)
 
 	return WriteFile(filepath.Join(targetDir, "settings.tf"), settingsContent)
 }
 
-// generateTFStateTF generates the tfstate.tf content and writes it to the custom service directory
-func generateTFStateTF(targetDir, stateKey string, cfg *config.Config, environment string) error {
-	// Get the region dynamically based on the current environment and configuration
-	accountID, err := getFieldValueByEnvironment(cfg.Profiles, environment)
-	if err != nil {
-		return err
+// generateTFStateTF generates the tfstate.tf content, the remote state of the parent service and
+// the variables its backend reads, and writes it to the custom service directory
+func generateTFStateTF(targetDir string, parent *config.Target) error {
+	tfstateContent := parent.Backend.RemoteStateBlock("wrapter", parent, targetDir)
+	if variables := parent.Backend.RemoteStateVariables(parent); variables != "" {
+		tfstateContent += "\n\n" + variables
 	}
-	region := cfg.DefaultRegions[accountID]
-
-	// Fetch the endpoint value from the configuration
-	endpoint := cfg.Environments.Endpoint
-
-	tfstateContent := fmt.Sprintf(`data "terraform_remote_state" "wrapter" {
-  backend = "s3"
-  config = {
-    endpoint                    = "%s"
-    bucket                      = "%s-tfstates"
-    key                         = "%s"
-    region                      = "%s"
-    access_key                  = var.MINIO_ACCESS_KEY
-    secret_key                  = var.MINIO_SECRET_KEY
-    skip_credentials_validation = true
-    skip_metadata_api_check     = true
-    skip_requesting_account_id  = true
-  }
-}`, endpoint, cfg.Tofu.Project, stateKey, region)
-
 	return WriteFile(filepath.Join(targetDir, "tfstate.tf"), tfstateContent)
 }
 
+// generateProviderTF writes provider.tf with the backend block of the target's state backend
+func generateProviderTF(targetDir string, target *config.Target) error {
+	providerContent := fmt.Sprintf(providerTfContent, target.Backend.BackendBlock())
+	return WriteFile(filepath.Join(targetDir, "provider.tf"), providerContent)
+}
+
 // copyStaticFile writes the embedded content of a static file to the target directory
 func copyStaticFile(filename, targetDir string) error {
 	var content string
 
 	switch filename {
-	case "provider.tf":
-		content = providerTfContent
 	case "variables.tf":
 		content = variablesTfContent
 	default:
@@ -480,22 +342,20 @@ func copyStaticFile(filename, targetDir string) error {
 }
 
 // createCustomServiceFiles creates the directory structure and required files for the custom service
-func createCustomServiceFiles(cfg *config.Config, environment, teamName, serviceName string) error {
-	accountID, region, err := getAccountAndRegion(cfg, environment)
+func createCustomServiceFiles(resolver *config.Resolver, target *config.Target, teamName, serviceName string) error {
+	// Build the directory of the service being extended from the repository layout
+	serviceDir, err := resolver.StackDir(target, teamName, serviceName)
 	if err != nil {
-		return fmt.Errorf("could not get account and region: %w", err)
+		return fmt.Errorf("could not build service directory: %w", err)
 	}
-
-	// Determine the root directory for git
-	gitRoot, err := common.FindGitRoot()
+	teamDir, err := resolver.TeamDir(target, teamName)
 	if err != nil {
-		return fmt.Errorf("could not find git root: %w", err)
+		return fmt.Errorf("could not build team directory: %w", err)
+	}
+	customServiceDir, err := resolver.StackDir(target, teamName, serviceName+customSuffix)
+	if err != nil {
+		return fmt.Errorf("could not build custom service directory: %w", err)
 	}
-
-	// Create the target directory structure
-	teamDir := filepath.Join(gitRoot, accountID, environment, region, teamName)
-	serviceDir := filepath.Join(teamDir, serviceName)
-	customServiceDir := serviceDir + "-custom"
 
 	// Check if team directory exists
 	if _, err := os.Stat(teamDir); os.IsNotExist(err) {
@@ -515,24 +375,24 @@ func createCustomServiceFiles(cfg *config.Config, environment, teamName, service
 	}
 
 	// Generate and write settings.tf
-	if err := generateCustomSettingsTF(customServiceDir, accountID); err != nil {
+	if err := generateCustomSettingsTF(customServiceDir, target.AccountID); err != nil {
 		return fmt.Errorf("could not create settings.tf: %w", err)
 	}
 
-	// Construct the state key dynamically using the project name, current directory, and the configuration
-	stateKey, err := ConstructCustomStateKey(cfg.Tofu.Project, customServiceDir, teamName, serviceName, cfg)
+	// The custom service reads the state of the service it extends
+	parent, err := resolver.Resolve(target.Environment, serviceDir)
 	if err != nil {
-		return fmt.Errorf("could not construct state key: %w", err)
+		return fmt.Errorf("could not resolve service %s: %w", serviceName, err)
 	}
 
 	// Generate and write tfstate.tf
-	if err := generateTFStateTF(customServiceDir, stateKey, cfg, environment); err != nil {
+	if err := generateTFStateTF(customServiceDir, parent); err != nil {
 		return fmt.Errorf("could not create tfstate.tf: %w", err)
 	}
 
-	// Copy static provider.tf
-	if err := copyStaticFile("provider.tf", customServiceDir); err != nil {
-		return fmt.Errorf("could not copy provider.tf: %w", err)
+	// Generate and write provider.tf
+	if err := generateProviderTF(customServiceDir, target); err != nil {
+		return fmt.Errorf("could not create provider.tf: %w", err)
 	}
 
 	return nil
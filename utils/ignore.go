@@ -0,0 +1,183 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"wrapter/config"
+)
+
+// IgnoreFile lists paths stack discovery skips, with the semantics of .gitignore. It is read
+// from the root and every directory below it, patterns being relative to the file's directory.
+const IgnoreFile = ".wrapterignore"
+
+// terraformExtensions are the extensions of the files making a directory a stack
+var terraformExtensions = []string{".tf", ".tofu"}
+
+// ignoreRule is a pattern of an ignore file
+type ignoreRule struct {
+	pattern *regexp.Regexp // Matches paths relative to the directory of the ignore file
+	negate  bool           // The pattern started with "!" and re-includes paths
+	dirOnly bool           // The pattern ended with "/" and only matches directories
+}
+
+// ignoreRules reads the ignore files of a repository, caching them by directory
+type ignoreRules struct {
+	root  string
+	rules map[string][]ignoreRule // Directory relative to the root to the rules of its ignore file
+}
+
+func newIgnoreRules(root string) *ignoreRules {
+	return &ignoreRules{root: root, rules: map[string][]ignoreRule{}}
+}
+
+// ignored reports whether a path relative to the root is ignored by the ignore files of its
+// parent directories, the last matching pattern of the deepest file deciding. Ignored parents
+// are not taken into account, see excluded.
+func (r *ignoreRules) ignored(rel string, isDir bool) (bool, error) {
+	var dirs []string
+	for dir := path.Dir(rel); ; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+		if dir == "." {
+			break
+		}
+	}
+
+	ignored := false
+	for _, dir := range dirs {
+		rules, err := r.load(dir)
+		if err != nil {
+			return false, err
+		}
+		name := rel
+		if dir != "." {
+			name = strings.TrimPrefix(rel, dir+"/")
+		}
+		for _, rule := range rules {
+			if (!rule.dirOnly || isDir) && rule.pattern.MatchString(name) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored, nil
+}
+
+// excluded reports whether a directory relative to the root, or one of its parents, is ignored
+func (r *ignoreRules) excluded(rel string) (bool, error) {
+	for current := rel; current != "."; current = path.Dir(current) {
+		ignored, err := r.ignored(current, true)
+		if err != nil || ignored {
+			return ignored, err
+		}
+	}
+	return false, nil
+}
+
+// load returns the rules of the ignore file of a directory relative to the root
+func (r *ignoreRules) load(dir string) ([]ignoreRule, error) {
+	if rules, cached := r.rules[dir]; cached {
+		return rules, nil
+	}
+
+	filename := filepath.Join(r.root, filepath.FromSlash(dir), IgnoreFile)
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		r.rules[dir] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		rule, ok, err := parseIgnoreLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, line, err)
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	r.rules[dir] = rules
+	return rules, nil
+}
+
+// parseIgnoreLine parses a line of an ignore file, ok is false for blank lines and comments
+func parseIgnoreLine(line string) (rule ignoreRule, ok bool, err error) {
+	// Trailing spaces are ignored unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = strings.TrimSuffix(line, " ")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false, nil
+	}
+
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+
+	// Patterns without a slash match at any depth, the others relative to the ignore file
+	if strings.Contains(line, "/") {
+		line = strings.TrimPrefix(line, "/")
+	} else {
+		line = "**/" + line
+	}
+
+	rule.pattern, err = config.GlobRegexp(line)
+	return rule, err == nil, err
+}
+
+// hasTerraformFiles reports whether a directory holds Terraform or OpenTofu files that the
+// ignore files don't exclude
+func hasTerraformFiles(dir string, rules *ignoreRules, rel string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !isTerraformFile(entry.Name()) {
+			continue
+		}
+		ignored, err := rules.ignored(path.Join(rel, entry.Name()), false)
+		if err != nil {
+			return false, err
+		}
+		if !ignored {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isTerraformFile reports whether a file name has a Terraform or OpenTofu extension
+func isTerraformFile(name string) bool {
+	for _, extension := range terraformExtensions {
+		if strings.HasSuffix(name, extension) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHidden reports whether a directory name is hidden, which covers VCS directories such as
+// .git and tool state such as .terraform
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".") && name != "." && name != ".."
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseIgnoreLine(t *testing.T) {
+	for _, test := range []struct {
+		line    string
+		negate  bool
+		dirOnly bool
+		match   []string
+		noMatch []string
+	}{
+		{line: "**/x", match: []string{"x", "a/x", "a/b/x"}, noMatch: []string{"ax", "x/a"}},
+		{line: "a/**/b", match: []string{"a/b", "a/x/b", "a/x/y/b"}, noMatch: []string{"c/a/b", "a/bc"}},
+		{line: "!neg", negate: true, match: []string{"neg", "a/neg"}, noMatch: []string{"negative"}},
+		{line: "/anchored", match: []string{"anchored"}, noMatch: []string{"a/anchored"}},
+		{line: "dir/", dirOnly: true, match: []string{"dir", "a/dir"}, noMatch: []string{"dirs"}},
+		{line: "a/dir/", dirOnly: true, match: []string{"a/dir"}, noMatch: []string{"b/a/dir"}},
+		{line: "*.tf", match: []string{"main.tf", "a/main.tf"}, noMatch: []string{"main.tfvars"}},
+		{line: `\!important`, match: []string{"!important"}, noMatch: []string{"important"}},
+		{line: "trailing   ", match: []string{"trailing"}, noMatch: []string{"trailing   "}},
+	} {
+		rule, ok, err := parseIgnoreLine(test.line)
+		if err != nil || !ok {
+			t.Errorf("parseIgnoreLine(%q) = %v, %v", test.line, ok, err)
+			continue
+		}
+		if rule.negate != test.negate || rule.dirOnly != test.dirOnly {
+			t.Errorf("parseIgnoreLine(%q): negate %v, dirOnly %v", test.line, rule.negate, rule.dirOnly)
+		}
+		for _, name := range test.match {
+			if !rule.pattern.MatchString(name) {
+				t.Errorf("%q doesn't match %q", test.line, name)
+			}
+		}
+		for _, name := range test.noMatch {
+			if rule.pattern.MatchString(name) {
+				t.Errorf("%q matches %q", test.line, name)
+			}
+		}
+	}
+
+	for _, line := range []string{"", "   ", "# comment"} {
+		if _, ok, err := parseIgnoreLine(line); ok || err != nil {
+			t.Errorf("parseIgnoreLine(%q) = %v, %v, want a skipped line", line, ok, err)
+		}
+	}
+}
+
+func TestIgnoreRules(t *testing.T) {
+	root := t.TempDir()
+	for path, content := range map[string]string{
+		IgnoreFile:           "legacy/\n/sandbox\n*.bak\n",
+		"prod/" + IgnoreFile: "!legacy/\nwip\n",
+	} {
+		path = filepath.Join(root, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rules := newIgnoreRules(root)
+	for _, test := range []struct {
+		rel     string
+		isDir   bool
+		ignored bool
+	}{
+		{"legacy", true, true},
+		{"dev/legacy", true, true},
+		{"dev/legacy", false, false}, // Directory only pattern
+		{"prod/legacy", true, false}, // Re-included by the deeper file
+		{"sandbox", true, true},
+		{"dev/sandbox", true, false}, // Anchored to the root
+		{"prod/wip", true, true},
+		{"dev/wip", true, false}, // Only ignored below prod
+		{"prod/main.tf.bak", false, true},
+	} {
+		ignored, err := rules.ignored(test.rel, test.isDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ignored != test.ignored {
+			t.Errorf("ignored(%s, %v) = %v, want %v", test.rel, test.isDir, ignored, test.ignored)
+		}
+	}
+
+	if excluded, err := rules.excluded("dev/legacy/pay/ledger"); err != nil || !excluded {
+		t.Errorf("excluded(dev/legacy/pay/ledger) = %v, %v, want true", excluded, err)
+	}
+	if excluded, err := rules.excluded("prod/legacy/pay/ledger"); err != nil || excluded {
+		t.Errorf("excluded(prod/legacy/pay/ledger) = %v, %v, want false", excluded, err)
+	}
+}
@@ -0,0 +1,208 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"wrapter/config"
+)
+
+// Stack kinds
+const (
+	KindCommon = "common" // Service built from the common service module
+	KindCustom = "custom" // <service>-custom stack extending a common service
+)
+
+// customSuffix marks the directory of a custom service next to the service it extends
+const customSuffix = "-custom"
+
+// StackInfo describes a stack of the repository inventory
+type StackInfo struct {
+	ID            string   `json:"id"`
+	Kind          string   `json:"kind"`
+	Environment   string   `json:"env"`
+	Account       string   `json:"account"`
+	Region        string   `json:"region"`
+	Team          string   `json:"team"`
+	Service       string   `json:"service"`
+	ModuleVersion string   `json:"module_version"`
+	Components    []string `json:"components"`
+	Dir           string   `json:"dir"`
+}
+
+// StackFilter selects stacks of the inventory. Every field lists path.Match globs, a stack
+// matches a field when any of them matches; empty fields match everything.
+type StackFilter struct {
+	Environment   []string
+	Account       []string
+	Region        []string
+	Team          []string
+	Service       []string
+	Kind          []string
+	ModuleVersion []string
+	Component     []string
+}
+
+var (
+	moduleSourcePattern = regexp.MustCompile(`(?s)module\s+"common_modules"\s*\{.*?\bsource\s*=\s*"([^"]*)"`)
+	componentPattern    = regexp.MustCompile(`(?m)^\s*(\w+_enabled)\s*=\s*true\b`)
+)
+
+// Inventory returns every stack of the repository: the directories laid out according to the
+// layout that DiscoverStacks keeps, sorted by ID
+func Inventory(cfg *config.Config) ([]*StackInfo, error) {
+	resolver := config.NewResolver(cfg)
+	stacks, err := resolver.FindStacks()
+	if err != nil {
+		return nil, err
+	}
+	if stacks, err = DiscoverStacks(cfg, stacks); err != nil {
+		return nil, err
+	}
+
+	var inventory []*StackInfo
+	for _, stack := range stacks {
+		code, err := readTerraformFiles(stack.Dir)
+		if err != nil {
+			return nil, err
+		}
+		info := &StackInfo{
+			ID:          stack.ID,
+			Kind:        KindCommon,
+			Environment: stack.Environment,
+			Account:     stack.Account,
+			Region:      stack.Region,
+			Team:        stack.Team,
+			Service:     stack.Service,
+			Components:  []string{},
+			Dir:         stack.Dir,
+		}
+		if strings.HasSuffix(stack.Service, customSuffix) {
+			info.Kind = KindCustom
+		}
+
+		// Layouts without the account or region segment take them from the environment, as
+		// configured for the stack
+		if info.Account == "" || info.Region == "" {
+			stackCfg, err := cfg.ForDir(stack.Dir)
+			if err != nil {
+				return nil, err
+			}
+			if target, err := config.NewResolver(stackCfg).ResolveRegion(stack.Environment, stack.Region); err == nil {
+				info.Account, info.Region = target.AccountID, target.Region
+			}
+		}
+
+		if match := moduleSourcePattern.FindStringSubmatch(code); match != nil {
+			if _, ref, found := strings.Cut(match[1], "?ref="); found {
+				info.ModuleVersion, _, _ = strings.Cut(ref, "&")
+			}
+		}
+		for _, match := range componentPattern.FindAllStringSubmatch(code, -1) {
+			for _, component := range serviceComponents {
+				if component.Flag == match[1] {
+					info.Components = append(info.Components, component.Name)
+				}
+			}
+		}
+
+		inventory = append(inventory, info)
+	}
+	return inventory, nil
+}
+
+// Match reports whether the stack passes every field of the filter
+func (f *StackFilter) Match(info *StackInfo) bool {
+	return matchAny(f.Environment, info.Environment) &&
+		matchAny(f.Account, info.Account) &&
+		matchAny(f.Region, info.Region) &&
+		matchAny(f.Team, info.Team) &&
+		matchAny(f.Service, info.Service) &&
+		matchAny(f.Kind, info.Kind) &&
+		matchAny(f.ModuleVersion, info.ModuleVersion) &&
+		matchAnyOf(f.Component, info.Components)
+}
+
+// Empty reports whether the filter has no patterns and matches every stack
+func (f *StackFilter) Empty() bool {
+	for _, patterns := range [][]string{f.Environment, f.Account, f.Region, f.Team, f.Service, f.Kind, f.ModuleVersion, f.Component} {
+		if len(patterns) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks the syntax of the filter patterns
+func (f *StackFilter) Validate() error {
+	for _, patterns := range [][]string{f.Environment, f.Account, f.Region, f.Team, f.Service, f.Kind, f.ModuleVersion, f.Component} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Filter returns the stacks of the inventory matching the filter
+func (f *StackFilter) Filter(inventory []*StackInfo) []*StackInfo {
+	var result []*StackInfo
+	for _, info := range inventory {
+		if f.Match(info) {
+			result = append(result, info)
+		}
+	}
+	return result
+}
+
+// matchAny reports whether value matches one of the patterns, or there are no patterns
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAnyOf reports whether one of the values matches one of the patterns, or there are no patterns
+func matchAnyOf(patterns []string, values []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if matchAny(patterns, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// readTerraformFiles returns the concatenated content of the Terraform and OpenTofu files of a directory
+func readTerraformFiles(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for _, entry := range entries {
+		if entry.IsDir() || !isTerraformFile(entry.Name()) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return "", err
+		}
+		sb.Write(data)
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
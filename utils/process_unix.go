@@ -0,0 +1,21 @@
+//go:build !windows
+
+package utils
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// isolateProcess starts the process in its own process group, so that a Ctrl-C in the terminal
+// reaches it only once, through wrapter. A second interrupt makes tofu exit without releasing
+// its state lock.
+func isolateProcess(command *exec.Cmd) {
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// interruptProcess asks a process to stop gracefully
+func interruptProcess(process *os.Process) error {
+	return process.Signal(os.Interrupt)
+}
@@ -0,0 +1,16 @@
+//go:build windows
+
+package utils
+
+import (
+	"os"
+	"os/exec"
+)
+
+// isolateProcess is a no-op, processes can't be interrupted individually on Windows
+func isolateProcess(command *exec.Cmd) {}
+
+// interruptProcess stops a process; Windows has no interrupt signal to send it
+func interruptProcess(process *os.Process) error {
+	return process.Kill()
+}
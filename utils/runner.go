@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"wrapter/config"
+)
+
+// Invocation is a tool invocation: a program and its arguments, run in a directory with
+// additional environment variables
+type Invocation struct {
+	Name       string
+	Args       []string
+	Env        []string  // NAME=value entries added to the environment of wrapter
+	Dir        string    // Working directory, the current one when empty
+	Stdout     io.Writer // os.Stdout when nil
+	Stderr     io.Writer // os.Stderr when nil
+	OutputFile string    // File receiving the standard output instead of Stdout, relative to Dir
+}
+
+// Runner runs tool invocations. Invocations still running when ctx is done are stopped.
+type Runner interface {
+	Run(ctx context.Context, invocation *Invocation) error
+}
+
+// DefaultGracePeriod is how long a process may take to stop after being interrupted
+const DefaultGracePeriod = 30 * time.Second
+
+// CommandRunner runs the tool invocations of every command; --dry-run replaces it with a
+// printing RecordingRunner
+var CommandRunner Runner = &ExecRunner{GracePeriod: DefaultGracePeriod}
+
+// DryRun is set by --dry-run along with a printing CommandRunner: tasks then skip everything
+// else with side effects, such as resolving secrets, running credential helpers or writing files
+var DryRun bool
+
+// ExecRunner runs invocations as processes. The processes don't receive the signals sent to
+// wrapter's process group: when the context is done they get a single SIGINT, which lets tofu
+// release its state lock, and are killed if they are still running after GracePeriod.
+type ExecRunner struct {
+	GracePeriod time.Duration
+}
+
+func (r *ExecRunner) Run(ctx context.Context, invocation *Invocation) error {
+	if err := ctx.Err(); err != nil {
+		return context.Cause(ctx)
+	}
+
+	command := exec.CommandContext(ctx, invocation.Name, invocation.Args...)
+	isolateProcess(command)
+	command.Cancel = func() error { return interruptProcess(command.Process) }
+	command.WaitDelay = r.GracePeriod
+	command.Dir = invocation.Dir
+	command.Env = append(os.Environ(), invocation.Env...)
+	command.Stdout = orWriter(invocation.Stdout, os.Stdout)
+	command.Stderr = orWriter(invocation.Stderr, os.Stderr)
+
+	if invocation.OutputFile != "" {
+		path := invocation.OutputFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(invocation.Dir, path)
+		}
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		command.Stdout = file
+	}
+
+	err := command.Run()
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%w (%v)", context.Cause(ctx), err)
+	}
+	return err
+}
+
+// RecordingRunner records invocations instead of running them. With Print set, each one is also
+// written to the invocation's Stdout as a shell command line, see Invocation.String.
+type RecordingRunner struct {
+	Print       bool
+	mu          sync.Mutex
+	Invocations []*Invocation
+}
+
+func (r *RecordingRunner) Run(ctx context.Context, invocation *Invocation) error {
+	if err := ctx.Err(); err != nil {
+		return context.Cause(ctx)
+	}
+
+	r.mu.Lock()
+	r.Invocations = append(r.Invocations, invocation)
+	r.mu.Unlock()
+
+	if r.Print {
+		_, err := fmt.Fprintln(orWriter(invocation.Stdout, os.Stdout), invocation.String())
+		return err
+	}
+	return nil
+}
+
+// String renders the invocation as a shell command line with its secrets masked
+func (i *Invocation) String() string {
+	word := func(s string) string { return shellQuote(config.Mask(s)) }
+
+	var parts []string
+	if i.Dir != "" {
+		parts = append(parts, "cd", word(i.Dir), "&&")
+	}
+	for _, entry := range i.Env {
+		name, value, _ := strings.Cut(entry, "=")
+		parts = append(parts, name+"="+word(value))
+	}
+	parts = append(parts, word(i.Name))
+	for _, arg := range i.Args {
+		parts = append(parts, word(arg))
+	}
+	if i.OutputFile != "" {
+		parts = append(parts, ">", word(i.OutputFile))
+	}
+	return strings.Join(parts, " ")
+}
+
+var shellSafePattern = regexp.MustCompile(`^[A-Za-z0-9_./:=@%+,-]+$`)
+
+// shellQuote quotes a word for the shell when it needs it
+func shellQuote(word string) string {
+	if shellSafePattern.MatchString(word) {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
+
+// orWriter returns writer, or fallback when it is nil
+func orWriter(writer, fallback io.Writer) io.Writer {
+	if writer == nil {
+		return fallback
+	}
+	return writer
+}
@@ -1,11 +1,13 @@
 package utils
 
 import (
+	"io"
 	"log"
 	"os"
+	"wrapter/config"
 )
 
-// WarnValidation returns the environment variable for validation warning
+// WarnValidation reports whether ALLOW_FAIL_VALIDATION is set, making validation failures warnings
 func WarnValidation() bool {
 	return os.Getenv("ALLOW_FAIL_VALIDATION") != ""
 }
@@ -15,6 +17,23 @@ func LogErrorAndExit(msg string, err error) {
 	log.Fatalf("%s: %v", msg, err)
 }
 
+// maskingWriter hides the resolved secrets in everything written through it
+type maskingWriter struct {
+	out io.Writer
+}
+
+func (w maskingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.out, config.Mask(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// MaskLogOutput masks resolved secrets in the output of the standard logger
+func MaskLogOutput() {
+	log.SetOutput(maskingWriter{out: os.Stderr})
+}
+
 // CreateTargetDir ensures that the target directory exists
 func CreateTargetDir(path string) error {
 	return os.MkdirAll(path, os.ModePerm)
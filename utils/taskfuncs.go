@@ -1,230 +1,156 @@
 package utils
 
 import (
+	"context"
 	"fmt"
-	"os"
-	"os/exec"
 	"wrapter/config"
 )
 
-// InitializeBackend initializes the Terraform backend
-func InitializeBackend(cfg *config.Config) error {
-	endpoint := cfg.Environments.Endpoint
-
-	// Determine the environment based on the current directory
-	currentDir, err := os.Getwd()
+// InitializeBackend initializes the Terraform backend of the stack in dir
+func InitializeBackend(ctx context.Context, cfg *config.Config, dir string) error {
+	// Resolve the account, region and state key of the stack
+	target, err := config.NewResolver(cfg).Resolve("", dir)
 	if err != nil {
 		return err
 	}
+	fmt.Println("Region:", target.Region)
 
-	// Construct the state key dynamically using the project name, current directory, and the configuration
-	stateKey, err := ConstructStateKey(cfg.Tofu.Project, currentDir, cfg)
+	// Credentials are passed through a private temporary file instead of the command line
+	creds, err := resolveCredentials(target)
 	if err != nil {
 		return err
 	}
-
-	// fmt.Println("State key:", stateKey)
-	// Get the region dynamically based on the current environment and configuration
-	environment := ExtractEnvironmentFromPath(currentDir)
-	accountID, err := getFieldValueByEnvironment(cfg.Profiles, environment)
+	credentialsFile, cleanup, err := writeCredentialsFile(target, creds)
+	defer cleanup()
 	if err != nil {
 		return err
 	}
-	region := cfg.DefaultRegions[accountID]
-	fmt.Println("Region:", region)
-
-	// Run the `tofu init` command only once
-	command := exec.Command("tofu", "init",
-		"-backend-config=endpoint="+endpoint,
-		"-backend-config=bucket="+cfg.Tofu.Project+"-tfstates",
-		"-backend-config=region="+region, // Use the dynamically fetched region
-		"-backend-config=key="+stateKey,
-		"-backend-config=access_key="+os.Getenv("MINIO_ACCESS_KEY"),
-		"-backend-config=secret_key="+os.Getenv("MINIO_SECRET_KEY"),
-		"-reconfigure",
-	)
-
-	command.Stdout = os.Stdout
-	command.Stderr = os.Stderr
-	command.Env = append(os.Environ(), "TF_CLI_CONFIG_FILE="+cfg.TerraformCliConfigPath)
-
-	if err := command.Run(); err != nil {
-		return err
-	}
 
-	return nil
+	return CommandRunner.Run(ctx, &Invocation{
+		Name: "tofu",
+		Args: initArgs(target, credentialsFile),
+		Env:  toolEnv(cfg),
+		Dir:  dir,
+	})
 }
 
-// RunLinter runs the linter for Terraform configurations
-func RunLinter(cfg *config.Config) error {
-	dirs, err := ListDirs()
-	if err != nil {
-		return err
+// initArgs returns the arguments of the `tofu init` configuring the backend of a target
+func initArgs(target *config.Target, credentialsFile string) []string {
+	args := []string{"init"}
+	for _, setting := range target.BackendConfig() {
+		args = append(args, "-backend-config="+setting)
 	}
-
-	for _, dir := range dirs {
-		println("Running TFlint for:", dir)
-		command := exec.Command("sh", "-c", "tflint && tofu fmt -diff -check=true || (echo 'Run tofu fmt before commit!!!'; exit 1)")
-		command.Dir = dir
-		command.Stdout = os.Stdout
-		command.Stderr = os.Stderr
-		command.Env = append(os.Environ(), "TF_CLI_CONFIG_FILE="+cfg.TerraformCliConfigPath)
-
-		if err := command.Run(); err != nil {
-			return err
-		}
+	if credentialsFile != "" {
+		args = append(args, "-backend-config="+credentialsFile)
 	}
-
-	return nil
+	return append(args, "-reconfigure")
 }
 
-// GenerateDocs generates documentation for Terraform configurations
-func GenerateDocs(cfg *config.Config) error {
-	dirs, err := ListDirs()
-	if err != nil {
-		return err
-	}
-
-	for _, dir := range dirs {
-		command := exec.Command("terraform-docs", "markdown", "table", "--output-file", "README.md", "--output-mode", "inject", dir)
-		command.Stdout = os.Stdout
-		command.Stderr = os.Stderr
-		command.Env = append(os.Environ(), "TF_CLI_CONFIG_FILE="+cfg.TerraformCliConfigPath)
-
-		if err := command.Run(); err != nil {
-			return err
-		}
-	}
-
-	return nil
+// toolEnv returns the environment entries of tool invocations, followed by the extra ones
+func toolEnv(cfg *config.Config, extra ...string) []string {
+	return append([]string{"TF_CLI_CONFIG_FILE=" + cfg.TerraformCliConfigPath}, extra...)
 }
 
-// FormatCode formats the Terraform code
-func FormatCode(cfg *config.Config) error {
-	dirs, err := ListDirs()
-	if err != nil {
-		return err
-	}
-
-	for _, dir := range dirs {
-		println("Running tofu fmt in the", dir)
-		command := exec.Command("tofu", "fmt")
-		command.Dir = dir
-		command.Stdout = os.Stdout
-		command.Stderr = os.Stderr
-		command.Env = append(os.Environ(), "TF_CLI_CONFIG_FILE="+cfg.TerraformCliConfigPath)
-
-		if err := command.Run(); err != nil {
-			return err
+// RunLinter runs the linter in each of the given directories
+func RunLinter(ctx context.Context, cfg *config.Config, dirs []string, opts BatchOptions) error {
+	return runBatch(ctx, cfg, dirs, opts, "lint", func(job *batchJob) error {
+		job.Println("Running TFlint for:", job.Dir)
+		err := job.run("tflint")
+		if err == nil {
+			err = job.run("tofu", "fmt", "-diff", "-check=true")
 		}
-	}
+		if err != nil {
+			job.Println("Run tofu fmt before commit!!!")
+		}
+		return err
+	})
+}
 
-	return nil
+// GenerateDocs generates the documentation of each of the given directories
+func GenerateDocs(ctx context.Context, cfg *config.Config, dirs []string, opts BatchOptions) error {
+	return runBatch(ctx, cfg, dirs, opts, "doc", func(job *batchJob) error {
+		return job.run("terraform-docs", "markdown", "table", "--output-file", "README.md", "--output-mode", "inject", ".")
+	})
 }
 
-// LockProviders locks Terraform providers
-func LockProviders(cfg *config.Config) error {
-	dirs, err := ListDirs()
-	if err != nil {
-		return err
-	}
+// FormatCode formats the Terraform code in each of the given directories
+func FormatCode(ctx context.Context, cfg *config.Config, dirs []string, opts BatchOptions) error {
+	return runBatch(ctx, cfg, dirs, opts, "fmt", func(job *batchJob) error {
+		job.Println("Running tofu fmt in the", job.Dir)
+		return job.run("tofu", "fmt")
+	})
+}
 
-	for _, dir := range dirs {
-		println("Running tofu lock in the", dir)
-		command := exec.Command("tofu", "providers", "lock",
+// LockProviders locks the Terraform providers of each of the given directories
+func LockProviders(ctx context.Context, cfg *config.Config, dirs []string, opts BatchOptions) error {
+	return runBatch(ctx, cfg, dirs, opts, "lock", func(job *batchJob) error {
+		job.Println("Running tofu lock in the", job.Dir)
+		return job.run("tofu", "providers", "lock",
 			"-platform=linux_amd64",
 			"-platform=darwin_amd64",
 			"-platform=darwin_arm64",
 		)
-		command.Dir = dir
-		command.Stdout = os.Stdout
-		command.Stderr = os.Stderr
-		command.Env = append(os.Environ(), "TF_CLI_CONFIG_FILE="+cfg.TerraformCliConfigPath)
+	})
+}
 
-		if err := command.Run(); err != nil {
+// ValidateConfiguration validates the Terraform configuration in each of the given directories.
+// With ALLOW_FAIL_VALIDATION set, failures are reported as a warning.
+func ValidateConfiguration(ctx context.Context, cfg *config.Config, dirs []string, opts BatchOptions) error {
+	opts.WarnOnly = opts.WarnOnly || WarnValidation()
+	return runBatch(ctx, cfg, dirs, opts, "validate", func(job *batchJob) error {
+		job.Println("Running tofu validate in the", job.Dir)
+		if err := job.install("tofu", "init", "-input=false", "-backend=false"); err != nil {
 			return err
 		}
-	}
-
-	return nil
-}
-
-// ValidateConfiguration validates the Terraform configuration
-func ValidateConfiguration(cfg *config.Config) error {
-	dirs, err := ListDirs()
-	if err != nil {
-		return err
-	}
-
-	for _, dir := range dirs {
-		println("Running tofu validate in the", dir)
-		command := exec.Command("sh", "-c",
-			"tofu init -input=false -backend=false && tofu validate && tflint",
-		)
-		command.Dir = dir
-		command.Stdout = os.Stdout
-		command.Stderr = os.Stderr
-		command.Env = append(os.Environ(), "TF_CLI_CONFIG_FILE="+cfg.TerraformCliConfigPath)
-
-		if err := command.Run(); err != nil {
+		if err := job.run("tofu", "validate"); err != nil {
 			return err
 		}
-	}
-
-	return nil
+		return job.run("tflint")
+	})
 }
 
-// Plan generates a Terraform plan
-func Plan(cfg *config.Config) error {
-	// Get the current working directory
-	currentDir, err := os.Getwd()
+// Plan generates a Terraform plan of the stack in dir
+func Plan(ctx context.Context, cfg *config.Config, dir string) error {
+	// Resolve the account, region and state key of the stack
+	target, err := config.NewResolver(cfg).Resolve("", dir)
 	if err != nil {
-		return fmt.Errorf("could not get current directory: %w", err)
+		return fmt.Errorf("could not resolve stack target: %w", err)
 	}
 
-	// Construct the state key dynamically using the project name, current directory, and the configuration
-	stateKey, err := ConstructStateKey(cfg.Tofu.Project, currentDir, cfg)
+	// Credentials are passed through a private temporary file instead of the command line
+	creds, err := resolveCredentials(target)
 	if err != nil {
-		return fmt.Errorf("could not construct state key: %w", err)
-	}
-
-	// Extract the environment from the current directory
-	environment := ExtractEnvironmentFromPath(currentDir)
-	if environment == "" {
-		return fmt.Errorf("could not determine environment from path: %s", currentDir)
+		return err
 	}
-
-	// Get the account ID for the current environment from the profiles
-	accountID, err := getFieldValueByEnvironment(cfg.Profiles, environment)
+	credentialsFile, cleanup, err := writeCredentialsFile(target, creds)
+	defer cleanup()
 	if err != nil {
-		return fmt.Errorf("could not get account ID for environment %s: %w", environment, err)
+		return err
 	}
 
-	// Get the region for the account ID from the default regions map
-	region, exists := cfg.DefaultRegions[accountID]
-	if !exists {
-		return fmt.Errorf("region not found for account ID: %s", accountID)
+	// Input variables may reference secrets, they are only resolved now that they are needed
+	variables := target.VariablePlaceholderEnv()
+	if !DryRun {
+		if variables, err = target.VariableEnv(); err != nil {
+			return err
+		}
 	}
 
-	// Build the backend configuration command
-	commandStr := fmt.Sprintf(
-		"tofu init -backend-config=endpoint=%s -backend-config=bucket=%s-tfstates -backend-config=region=%s -backend-config=key=%s -backend-config=access_key=%s -backend-config=secret_key=%s -reconfigure && tofu plan -out tfplan.bin && tofu show --json tfplan.bin | jq > tfplan.json",
-		cfg.Environments.Endpoint,
-		cfg.Tofu.Project,
-		region,
-		stateKey,
-		os.Getenv("MINIO_ACCESS_KEY"),
-		os.Getenv("MINIO_SECRET_KEY"),
-	)
-
-	// Execute the command
-	command := exec.Command("sh", "-c", commandStr)
-	command.Stdout = os.Stdout
-	command.Stderr = os.Stderr
-	command.Env = append(os.Environ(), "TF_CLI_CONFIG_FILE="+cfg.TerraformCliConfigPath)
+	// Remote state data sources, such as the one of custom services, read the same credentials
+	// as the backend; configured variables of the same name come later and win
+	variables = append(target.Backend.RemoteStateEnv(creds), variables...)
 
-	if err := command.Run(); err != nil {
-		return fmt.Errorf("plan generation failed: %w", err)
+	// Initialize the backend, plan and export the plan as JSON
+	env := toolEnv(cfg, variables...)
+	steps := []*Invocation{
+		{Name: "tofu", Args: initArgs(target, credentialsFile), Env: env, Dir: dir},
+		{Name: "tofu", Args: []string{"plan", "-out", "tfplan.bin"}, Env: env, Dir: dir},
+		{Name: "tofu", Args: []string{"show", "-json", "tfplan.bin"}, Env: env, Dir: dir, OutputFile: "tfplan.json"},
+	}
+	for _, step := range steps {
+		if err := CommandRunner.Run(ctx, step); err != nil {
+			return fmt.Errorf("plan generation failed: %w", err)
+		}
 	}
 
 	return nil
@@ -233,7 +159,7 @@ func Plan(cfg *config.Config) error {
 // BootstrapService bootstraps the service
 func BootstrapService(cfg *config.Config) error {
 	// Prompt for user inputs using the survey library
-	environments, err := promptForEnvironments()
+	environments, err := promptForEnvironments(cfg)
 	if err != nil {
 		return err
 	}
@@ -253,10 +179,33 @@ func BootstrapService(cfg *config.Config) error {
 		return err
 	}
 
+	// Resolve every selected environment and region up front so a misconfigured one fails before anything is written
+	resolver := config.NewResolver(cfg)
+	var targets []*config.Target
+	for _, env := range environments {
+		accountRegions, err := resolver.Regions(env)
+		if err != nil {
+			return fmt.Errorf("could not resolve environment %s: %w", env, err)
+		}
+
+		regions, err := promptForRegions(env, accountRegions)
+		if err != nil {
+			return err
+		}
+
+		for _, region := range regions {
+			target, err := resolver.ResolveRegion(env, region)
+			if err != nil {
+				return fmt.Errorf("could not resolve environment %s: %w", env, err)
+			}
+			targets = append(targets, target)
+		}
+	}
+
 	if serviceType == "custom" {
-		for _, env := range environments {
-			if err := createCustomServiceFiles(cfg, env, teamName, serviceName); err != nil {
-				return fmt.Errorf("failed to create custom service files for environment %s: %w", env, err)
+		for _, target := range targets {
+			if err := createCustomServiceFiles(resolver, target, teamName, serviceName); err != nil {
+				return fmt.Errorf("failed to create custom service files for environment %s in %s: %w", target.Environment, target.Region, err)
 			}
 		}
 		return nil
@@ -269,58 +218,12 @@ func BootstrapService(cfg *config.Config) error {
 		}
 
 		// Create directories and files for each selected environment
-		for _, env := range environments {
-			if err := createServiceFiles(cfg, env, teamName, serviceName, components); err != nil {
-				return fmt.Errorf("failed to create service files for environment %s: %w", env, err)
+		for _, target := range targets {
+			if err := createServiceFiles(cfg, resolver, target, teamName, serviceName, components); err != nil {
+				return fmt.Errorf("failed to create service files for environment %s in %s: %w", target.Environment, target.Region, err)
 			}
 		}
 	}
 
 	return nil
 }
-
-
-
-
-// BootstrapService bootstraps the service
-// func BootstrapService(cfg *config.Config) error {
-// 	// Prompt for user inputs using the survey library
-// 	environments, err := promptForEnvironments()
-// 	if err != nil {
-// 		return err
-// 	}
-
-// 	serviceType, err := promptForServiceType()
-// 	if err != nil {
-// 		return err
-// 	}
-
-// 	if serviceType != "new" {
-// 		fmt.Println("Custom service handling is not implemented yet.")
-// 		return nil
-// 	}
-
-// 	components, err := promptForComponents(cfg.CommonService.Services)
-// 	if err != nil {
-// 		return err
-// 	}
-
-// 	teamName, err := promptForText("Provide your team name and enter:")
-// 	if err != nil {
-// 		return err
-// 	}
-
-// 	serviceName, err := promptForText("Provide the service name and enter:")
-// 	if err != nil {
-// 		return err
-// 	}
-
-// 	// Create directories and files for each selected environment
-// 	for _, env := range environments {
-// 		if err := createServiceFiles(cfg, env, teamName, serviceName, components); err != nil {
-// 			return fmt.Errorf("failed to create service files for environment %s: %w", env, err)
-// 		}
-// 	}
-
-// 	return nil
-// }
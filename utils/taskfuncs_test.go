@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"wrapter/config"
+)
+
+const testConfig = `version: 2
+tofu:
+  project: company
+default_regions:
+  "111111111111": "us-east-1"
+state:
+  endpoint: "http://minio:9000"
+  credentials:
+    source: process
+    command: "echo the credential helper ran >&2; exit 1"
+variables:
+  region: "us-east-1"
+  token: "env:WRAPTER_TEST_UNSET_TOKEN"
+environments:
+  prod:
+    account: "111111111111"
+`
+
+// testRepository writes a repository with the given configuration and stacks, and loads it
+func testRepository(t *testing.T, configuration string, stacks ...string) *config.Config {
+	t.Helper()
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "invoke.yaml"), []byte(configuration), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, stack := range stacks {
+		dir := filepath.Join(root, filepath.FromSlash(stack))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "main.tf"), []byte("# stack\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg, err := config.Load(config.LoadOptions{Root: root, Dir: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// recordInvocations replaces CommandRunner with a RecordingRunner for the duration of the test
+func recordInvocations(t *testing.T, dryRun bool) *RecordingRunner {
+	t.Helper()
+	runner := &RecordingRunner{}
+	previousRunner, previousDryRun := CommandRunner, DryRun
+	CommandRunner, DryRun = runner, dryRun
+	t.Cleanup(func() { CommandRunner, DryRun = previousRunner, previousDryRun })
+	return runner
+}
+
+func TestPlanDryRun(t *testing.T) {
+	cfg := testRepository(t, testConfig, "111111111111/prod/us-east-1/pay/ledger")
+	runner := recordInvocations(t, true)
+	dir := filepath.Join(cfg.Root, "111111111111/prod/us-east-1/pay/ledger")
+
+	// Neither the unset variable nor the failing credential helper may stop a dry run
+	if err := Plan(context.Background(), cfg, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(runner.Invocations) != 3 {
+		t.Fatalf("recorded %d invocations, want 3", len(runner.Invocations))
+	}
+	wantInit := []string{
+		"init",
+		"-backend-config=endpoint=http://minio:9000",
+		"-backend-config=bucket=company-tfstates",
+		"-backend-config=region=us-east-1",
+		"-backend-config=key=company/111111111111/prod/us-east-1/pay/ledger/service.tfstate",
+		"-backend-config=" + dryRunCredentialsFile,
+		"-reconfigure",
+	}
+	wantEnv := []string{
+		"TF_CLI_CONFIG_FILE=" + filepath.Join(cfg.Root, "terraform.tfrc"),
+		"TF_VAR_MINIO_ACCESS_KEY=<access_key>",
+		"TF_VAR_MINIO_SECRET_KEY=<secret_key>",
+		"TF_VAR_region=us-east-1",
+		"TF_VAR_token=<env:WRAPTER_TEST_UNSET_TOKEN>",
+	}
+	for i, want := range [][]string{wantInit, {"plan", "-out", "tfplan.bin"}, {"show", "-json", "tfplan.bin"}} {
+		invocation := runner.Invocations[i]
+		if invocation.Name != "tofu" || !reflect.DeepEqual(invocation.Args, want) {
+			t.Errorf("invocation %d: %s %v, want tofu %v", i, invocation.Name, invocation.Args, want)
+		}
+		if !reflect.DeepEqual(invocation.Env, wantEnv) {
+			t.Errorf("invocation %d: env %v, want %v", i, invocation.Env, wantEnv)
+		}
+		if invocation.Dir != dir {
+			t.Errorf("invocation %d: dir %s, want %s", i, invocation.Dir, dir)
+		}
+	}
+	if output := runner.Invocations[2].OutputFile; output != "tfplan.json" {
+		t.Errorf("show output file %q, want tfplan.json", output)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tfplan.json")); !os.IsNotExist(err) {
+		t.Error("a dry run wrote tfplan.json")
+	}
+}
+
+func TestPlanResolvesSecrets(t *testing.T) {
+	configuration := strings.Replace(testConfig, `    source: process
+    command: "echo the credential helper ran >&2; exit 1"`, `    source: env`, 1)
+	cfg := testRepository(t, configuration, "111111111111/prod/us-east-1/pay/ledger")
+	runner := recordInvocations(t, false)
+	t.Setenv("WRAPTER_TEST_UNSET_TOKEN", "token-value")
+	t.Setenv("MINIO_ACCESS_KEY", "access-key-value")
+	t.Setenv("MINIO_SECRET_KEY", "secret-key-value")
+
+	if err := Plan(context.Background(), cfg, filepath.Join(cfg.Root, "111111111111/prod/us-east-1/pay/ledger")); err != nil {
+		t.Fatal(err)
+	}
+
+	initStep := runner.Invocations[0]
+	for _, entry := range []string{"TF_VAR_token=token-value", "TF_VAR_MINIO_ACCESS_KEY=access-key-value", "TF_VAR_MINIO_SECRET_KEY=secret-key-value"} {
+		if !contains(initStep.Env, entry) {
+			t.Errorf("env %v lacks %s", initStep.Env, entry)
+		}
+	}
+	for _, arg := range initStep.Args {
+		if strings.Contains(arg, "key-value") {
+			t.Errorf("credentials on the command line: %s", arg)
+		}
+	}
+	credentialsFile := strings.TrimPrefix(initStep.Args[len(initStep.Args)-2], "-backend-config=")
+	if !strings.HasSuffix(credentialsFile, ".tfbackend") {
+		t.Fatalf("no credentials file among %v", initStep.Args)
+	}
+	if _, err := os.Stat(credentialsFile); !os.IsNotExist(err) {
+		t.Error("the credentials file was not removed")
+	}
+}
+
+func TestPlanMissingSecret(t *testing.T) {
+	cfg := testRepository(t, strings.Replace(testConfig, "source: process", "source: profile\n    profile: ci", 1), "111111111111/prod/us-east-1/pay/ledger")
+	runner := recordInvocations(t, false)
+
+	err := Plan(context.Background(), cfg, filepath.Join(cfg.Root, "111111111111/prod/us-east-1/pay/ledger"))
+	if err == nil || !strings.Contains(err.Error(), "WRAPTER_TEST_UNSET_TOKEN") {
+		t.Fatalf("Plan() error %v, want the unset variable", err)
+	}
+	if len(runner.Invocations) != 0 {
+		t.Errorf("recorded %d invocations after the failure", len(runner.Invocations))
+	}
+}
+
+func TestFormatCodeDryRun(t *testing.T) {
+	cfg := testRepository(t, testConfig, "111111111111/prod/us-east-1/pay/ledger", "111111111111/prod/us-east-1/pay/ledger-custom")
+	runner := recordInvocations(t, true)
+	dirs := []string{
+		filepath.Join(cfg.Root, "111111111111/prod/us-east-1/pay/ledger"),
+		filepath.Join(cfg.Root, "111111111111/prod/us-east-1/pay/ledger-custom"),
+	}
+
+	if err := FormatCode(context.Background(), cfg, dirs, BatchOptions{Parallelism: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Root, ".wrapter")); !os.IsNotExist(err) {
+		t.Errorf("the dry run created the log directory (%v)", err)
+	}
+
+	if len(runner.Invocations) != len(dirs) {
+		t.Fatalf("recorded %d invocations, want %d", len(runner.Invocations), len(dirs))
+	}
+	for _, invocation := range runner.Invocations {
+		if invocation.Name != "tofu" || !reflect.DeepEqual(invocation.Args, []string{"fmt"}) {
+			t.Errorf("recorded %s %v, want tofu fmt", invocation.Name, invocation.Args)
+		}
+		if !contains(dirs, invocation.Dir) {
+			t.Errorf("recorded dir %s, want one of %v", invocation.Dir, dirs)
+		}
+	}
+}
+
+func TestFormatCodeLogs(t *testing.T) {
+	cfg := testRepository(t, testConfig, "111111111111/prod/us-east-1/pay/ledger", "111111111111/prod/us-east-1/pay/ledger-custom")
+	recordInvocations(t, false)
+	dirs := []string{
+		filepath.Join(cfg.Root, "111111111111/prod/us-east-1/pay/ledger"),
+		filepath.Join(cfg.Root, "111111111111/prod/us-east-1/pay/ledger-custom"),
+	}
+
+	if err := FormatCode(context.Background(), cfg, dirs, BatchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"prod/us-east-1/pay/ledger", "prod/us-east-1/pay/ledger-custom"} {
+		path := filepath.Join(cfg.Root, DefaultLogDir, "fmt", filepath.FromSlash(id)+".log")
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("log file of %s: %v", id, err)
+		}
+	}
+}
@@ -1,13 +1,9 @@
 package utils
 
-// Embedded content for provider.tf
+// Embedded content for provider.tf, the backend block comes from the configured state backend
 const providerTfContent = `terraform {
   required_version = ">= 1.0.0"
-  backend "s3" {
-    skip_credentials_validation = true
-    skip_metadata_api_check     = true
-  }
-}
+%s}
 `
 
 // Embedded content for variables.tf
@@ -27,7 +27,7 @@ func CheckBinary(binaryName string) error {
 
 // VerifyRequirements checks for all required binaries
 func VerifyRequirements() error {
-	requiredBinaries := []string{"tofu", "jq", "terraform-docs"}
+	requiredBinaries := []string{"tofu", "terraform-docs"}
 
 	for _, binary := range requiredBinaries {
 		if err := CheckBinary(binary); err != nil {